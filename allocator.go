@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrNumberRangeExhausted возвращается ClientRangeAllocator, если в диапазоне
+// клиента не осталось свободных номеров
+var ErrNumberRangeExhausted = errors.New("number range exhausted")
+
+// NumberAllocator выбирает номер для новой посылки без явно заданного номера.
+// Add вызывает NextNumber в своей транзакции перед вставкой. last(lo, hi)
+// возвращает наибольший номер в диапазоне [lo, hi], включая номера удалённых
+// посылок, или 0, если диапазон пуст; при первом вызове last хранилище
+// блокирует выдачу номеров до конца транзакции, так что параллельные Add
+// не получат один номер. NextNumber возвращает 0, чтобы номер выдала база.
+type NumberAllocator interface {
+	NextNumber(p Parcel, last func(lo, hi int) (int, error)) (int, error)
+}
+
+// AutoNumberAllocator — распределитель по умолчанию: номера выдаёт база
+// по возрастанию (autoincrement в SQLite, serial в PostgreSQL)
+type AutoNumberAllocator struct{}
+
+func (AutoNumberAllocator) NextNumber(Parcel, func(lo, hi int) (int, error)) (int, error) {
+	return 0, nil
+}
+
+// ClientRangeAllocator выдаёт посылкам каждого клиента номера из его
+// диапазона: от client*Size+1 до client*Size+Size-1 по возрастанию, например
+// при Size = 1_000_000 у клиента 42 номера 42000001, 42000002, ... Следующий
+// номер отсчитывается от наибольшего занятого, поэтому номер последней
+// посылки, стёртой Delete или PurgeDeletedBefore, может быть выдан повторно;
+// SoftDelete номер не освобождает. Номера, выданные базой, с диапазонами
+// не согласуются, так что в одной таблице распределители лучше не смешивать.
+type ClientRangeAllocator struct {
+	Size int
+}
+
+func (a ClientRangeAllocator) NextNumber(p Parcel, last func(lo, hi int) (int, error)) (int, error) {
+	if a.Size < 2 {
+		return 0, fmt.Errorf("client range size must be at least 2, got %d", a.Size)
+	}
+	if p.Client > (math.MaxInt-a.Size)/a.Size {
+		return 0, fmt.Errorf("client %d: %w", p.Client, ErrNumberRangeExhausted)
+	}
+
+	lo := p.Client*a.Size + 1
+	hi := p.Client*a.Size + a.Size - 1
+	n, err := last(lo, hi)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return lo, nil
+	}
+	if n >= hi {
+		return 0, fmt.Errorf("client %d: %w", p.Client, ErrNumberRangeExhausted)
+	}
+	return n + 1, nil
+}
+
+// allocateNumber спрашивает номер для посылки p у распределителя хранилища.
+// Выполняется внутри транзакции Add.
+func (s ParcelStore) allocateNumber(ctx context.Context, tx querier, p Parcel) (int, error) {
+	locked := false
+	last := func(lo, hi int) (int, error) {
+		if !locked {
+			if err := s.lockNumbers(ctx, tx); err != nil {
+				return 0, err
+			}
+			locked = true
+		}
+
+		var n int
+		row := tx.QueryRowContext(ctx,
+			"SELECT COALESCE(MAX(number), 0) FROM "+s.ident()+" WHERE number BETWEEN :lo AND :hi",
+			sql.Named("lo", lo),
+			sql.Named("hi", hi))
+		if err := row.Scan(&n); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	return s.allocator.NextNumber(p, last)
+}
+
+// lockNumbers не даёт параллельным транзакциям выдавать номера, пока текущая
+// не завершится: иначе две транзакции прочитали бы один и тот же наибольший
+// номер. В SQLite пустой UPDATE сразу берёт блокировку записи базы, которую
+// иначе транзакция получила бы только при вставке; в PostgreSQL берётся
+// рекомендательная блокировка таблицы посылок.
+func (s ParcelStore) lockNumbers(ctx context.Context, tx querier) error {
+	query := "UPDATE " + s.ident() + " SET number = number WHERE 0 = 1"
+	if s.dialect == DialectPostgres {
+		query = "SELECT pg_advisory_xact_lock(hashtext(:table))"
+	}
+	_, err := tx.ExecContext(ctx, query, sql.Named("table", s.table))
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestClientRangeAllocator проверяет, что посылки разных клиентов получают
+// номера из своих диапазонов
+func TestClientRangeAllocator(t *testing.T) {
+	// prepare
+	store := newTestStore(t, WithNumberAllocator(ClientRangeAllocator{Size: 1000}))
+
+	add := func(client int) int {
+		parcel := getTestParcel()
+		parcel.Client = client
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		return num
+	}
+
+	// add
+	first := add(1)
+	second := add(2)
+	third := add(1)
+	fourth := add(2)
+
+	// check
+	require.Equal(t, 1001, first)
+	require.Equal(t, 1002, third)
+	require.Equal(t, 2001, second)
+	require.Equal(t, 2002, fourth)
+
+	// номер помеченной удалённой посылки не выдаётся повторно
+	require.NoError(t, store.SoftDelete(third))
+	require.Equal(t, 1003, add(1))
+
+	// явно заданный номер распределитель не меняет
+	explicit := getTestParcel()
+	explicit.Client = 1
+	explicit.Number = 5
+	num, err := store.Add(explicit)
+	require.NoError(t, err)
+	require.Equal(t, 5, num)
+}
+
+// TestClientRangeAllocatorExhausted проверяет ошибку при заполненном диапазоне
+// и при неверном размере диапазона
+func TestClientRangeAllocatorExhausted(t *testing.T) {
+	// prepare
+	store := newTestStore(t, WithNumberAllocator(ClientRangeAllocator{Size: 3}))
+	parcel := getTestParcel()
+	parcel.Client = 1
+
+	// в диапазоне клиента 1 два номера: 4 и 5
+	for _, want := range []int{4, 5} {
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		require.Equal(t, want, num)
+	}
+	_, err := store.Add(parcel)
+	require.ErrorIs(t, err, ErrNumberRangeExhausted)
+
+	store = newTestStore(t, WithNumberAllocator(ClientRangeAllocator{Size: 1}))
+	_, err = store.Add(parcel)
+	require.Error(t, err)
+}
+
+// TestClientRangeAllocatorConcurrent проверяет, что параллельные Add одного
+// клиента получают разные номера из его диапазона
+func TestClientRangeAllocatorConcurrent(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db,
+		WithRetry(20, 5*time.Millisecond),
+		WithNumberAllocator(ClientRangeAllocator{Size: 1000}))
+	require.NoError(t, store.Migrate())
+
+	const (
+		workers = 8
+		perWork = 10
+	)
+	nums := make(chan int, workers*perWork)
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			errs <- func() error {
+				for i := 0; i < perWork; i++ {
+					num, err := store.Add(getTestParcel())
+					if err != nil {
+						return err
+					}
+					nums <- num
+				}
+				return nil
+			}()
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		require.NoError(t, <-errs)
+	}
+	close(nums)
+
+	// check
+	seen := map[int]bool{}
+	for num := range nums {
+		require.False(t, seen[num], "number %d allocated twice", num)
+		seen[num] = true
+		require.Greater(t, num, 1000*1000)
+		require.Less(t, num, 1000*1000+1000)
+	}
+	require.Len(t, seen, workers*perWork)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyBatchSize — сколько посылок CopyTo вставляет в базу назначения одним запросом
+const copyBatchSize = 100
+
+// CopyTo копирует все посылки в хранилище dst, например для резервной копии
+// в отдельный файл SQLite, и возвращает количество скопированных. Посылки
+// читаются по одной и вставляются пачками по copyBatchSize в одной транзакции
+// dst, так что при ошибке dst не меняется. Сохраняются все поля, включая номер
+// и версию; удалённые посылки и история изменений не копируются. Схема dst
+// должна быть создана заранее (Migrate), а посылок с теми же номерами в ней
+// быть не должно, иначе возвращается ErrDuplicateNumber. dst должно работать
+// с другой базой, чем s.
+func (s ParcelStore) CopyTo(dst ParcelStore) (int, error) {
+	return s.CopyToContext(context.Background(), dst)
+}
+
+func (s ParcelStore) CopyToContext(ctx context.Context, dst ParcelStore) (copied int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "CopyTo", start, err, slog.Int("copied", copied)) }()
+
+	err = dst.inTx(ctx, func(tx querier) error {
+		// при повторе транзакции копирование начинается заново
+		copied = 0
+		batch := make([]Parcel, 0, copyBatchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := dst.insertCopies(ctx, tx, batch); err != nil {
+				return err
+			}
+			copied += len(batch)
+			batch = batch[:0]
+			return nil
+		}
+
+		err := iterParcels(ctx, s.conn(), func(p Parcel) error {
+			batch = append(batch, p)
+			if len(batch) == copyBatchSize {
+				return flush()
+			}
+			return nil
+		}, "SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number")
+		if err != nil {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+
+		// в PostgreSQL вставка с явным номером не сдвигает последовательность,
+		// и без этого следующий Add в dst получил бы уже занятый номер
+		if dst.dialect == DialectPostgres && copied > 0 {
+			_, err := tx.ExecContext(ctx,
+				"SELECT setval(pg_get_serial_sequence(:table, 'number'), (SELECT MAX(number) FROM "+dst.ident()+"))",
+				sql.Named("table", dst.ident()))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		copied = 0
+		return 0, err
+	}
+	return copied, nil
+}
+
+// insertCopies вставляет посылки со всеми полями как есть одним запросом
+func (s ParcelStore) insertCopies(ctx context.Context, tx querier, parcels []Parcel) error {
+	rows := make([]string, len(parcels))
+	args := make([]any, 0, len(parcels)*15)
+	for i, p := range parcels {
+		metadata, err := encodeMetadata(p.Metadata)
+		if err != nil {
+			return fmt.Errorf("parcel %d: metadata: %w", p.Number, err)
+		}
+
+		n := strconv.Itoa(i)
+		values := []any{p.Number, p.Client, p.Status, p.Address, p.CreatedAt, p.UpdatedAt, p.Version,
+			p.ShippedAt, p.DeliveredAt, p.IdempotencyKey, p.Weight, metadata, p.Attempts,
+			nullString(p.DeliverAfter), nullString(p.DeliverBefore)}
+		params := make([]string, len(values))
+		for j, v := range values {
+			name := "p" + n + "_" + strconv.Itoa(j)
+			params[j] = ":" + name
+			args = append(args, sql.Named(name, v))
+		}
+		rows[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO "+s.ident()+" ("+parcelColumns+") VALUES "+strings.Join(rows, ", "), args...)
+	if s.isPrimaryKeyViolation(err) {
+		return fmt.Errorf("copy: %w", ErrDuplicateNumber)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestCopyTo проверяет, что CopyTo переносит посылки в другую базу без изменений
+func TestCopyTo(t *testing.T) {
+	// prepare
+	src := newTestStore(t)
+	dst := newTestStore(t)
+
+	// посылок больше одной пачки, и у части из них изменены поля
+	for i := 0; i < copyBatchSize+5; i++ {
+		parcel := getTestParcel()
+		parcel.Client = 1000 + i%3
+		parcel.Weight = float64(i)
+		if i%10 == 0 {
+			parcel.Metadata = map[string]string{"fragile": "true"}
+		}
+		num, err := src.Add(parcel)
+		require.NoError(t, err)
+		if i%7 == 0 {
+			require.NoError(t, src.Ship(num))
+			_, _, err := src.RecordDeliveryAttempt(num)
+			require.NoError(t, err)
+		}
+	}
+	deleted, err := src.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, src.Delete(deleted))
+
+	// copy
+	copied, err := src.CopyTo(dst)
+	require.NoError(t, err)
+	require.Equal(t, copyBatchSize+5, copied)
+
+	// check
+	want, err := src.GetAll()
+	require.NoError(t, err)
+	got, err := dst.GetAll()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+
+	// номера в dst продолжаются после скопированных
+	num, err := dst.Add(getTestParcel())
+	require.NoError(t, err)
+	require.Greater(t, num, want[len(want)-1].Number)
+
+	// повторное копирование не меняет dst
+	_, err = src.CopyTo(dst)
+	require.ErrorIs(t, err, ErrDuplicateNumber)
+	got, err = dst.GetAll()
+	require.NoError(t, err)
+	require.Len(t, got, len(want)+1)
+}
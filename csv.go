@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// ErrMalformedCSV возвращается ImportCSV для строки, из которой нельзя получить посылку
+var ErrMalformedCSV = errors.New("malformed csv")
+
+// csvHeader — заголовок CSV-выгрузки посылок
+var csvHeader = []string{"number", "client", "status", "address", "created_at"}
+
+// ExportClientCSV записывает посылки клиента в w в формате CSV с заголовком
+// number,client,status,address,created_at. Если запись в w не удалась,
+// возвращается её ошибка.
+func (s ParcelStore) ExportClientCSV(client int, w io.Writer) error {
+	return s.ExportClientCSVContext(context.Background(), client, w)
+}
+
+func (s ParcelStore) ExportClientCSVContext(ctx context.Context, client int, w io.Writer) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ExportClientCSV", start, err, slog.Int("client", client)) }()
+
+	parcels, err := s.GetByClientContext(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, p := range parcels {
+		record := []string{
+			strconv.Itoa(p.Number),
+			strconv.Itoa(p.Client),
+			string(p.Status),
+			p.Address,
+			p.CreatedAt,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ImportCSV читает посылки из r в формате ExportClientCSV и добавляет их в одной
+// транзакции. Первая строка считается заголовком и пропускается, колонка number
+// игнорируется — номера выдаёт хранилище. Если created_at пустой, время создания
+// берётся по часам хранилища. При ошибке в любой строке не добавляется ничего,
+// а ошибка содержит номер строки и оборачивает ErrMalformedCSV.
+func (s ParcelStore) ImportCSV(r io.Reader) (imported int, err error) {
+	return s.ImportCSVContext(context.Background(), r)
+}
+
+func (s ParcelStore) ImportCSVContext(ctx context.Context, r io.Reader) (imported int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ImportCSV", start, err, slog.Int("imported", imported)) }()
+
+	parcels, err := readParcelsCSV(r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.inTx(ctx, func(tx querier) error {
+		for _, p := range parcels {
+			if _, err := s.addParcel(ctx, tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(parcels), nil
+}
+
+// readParcelsCSV разбирает CSV целиком, чтобы некорректная строка
+// обнаружилась до начала вставки
+func readParcelsCSV(r io.Reader) ([]Parcel, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+
+	var parcels []Parcel
+	for header := true; ; header = false {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return parcels, nil
+		}
+		if err != nil {
+			// ошибки csv.Reader уже содержат номер строки
+			return nil, fmt.Errorf("%w: %w", ErrMalformedCSV, err)
+		}
+		if header {
+			continue
+		}
+
+		line, _ := cr.FieldPos(0)
+		p, err := parseParcelRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrMalformedCSV, line, err)
+		}
+		parcels = append(parcels, p)
+	}
+}
+
+// parseParcelRecord преобразует строку CSV в посылку; порядок колонок — csvHeader
+func parseParcelRecord(record []string) (Parcel, error) {
+	client, err := strconv.Atoi(record[1])
+	if err != nil {
+		return Parcel{}, fmt.Errorf("invalid client %q", record[1])
+	}
+	status, err := ParseStatus(record[2])
+	if err != nil {
+		return Parcel{}, err
+	}
+	createdAt, err := normalizeTimestamp(record[4])
+	if err != nil {
+		return Parcel{}, err
+	}
+
+	p := Parcel{
+		Client:    client,
+		Status:    status,
+		Address:   record[3],
+		CreatedAt: createdAt,
+	}
+	return p, p.Validate()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingWriter — io.Writer, который всегда возвращает ошибку
+type failingWriter struct{}
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWriteFailed
+}
+
+// TestExportClientCSV проверяет выгрузку посылок клиента в CSV
+func TestExportClientCSV(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	var err error
+
+	client := 1 + randRange.Intn(10_000_000)
+	parcels := []Parcel{getTestParcel(), getTestParcel()}
+	parcels[1].Address = "Москва, ул. \"Ленина\", д. 1, кв. 2"
+	for i := range parcels {
+		parcels[i].Client = client
+		parcels[i].Number, err = store.Add(parcels[i])
+		require.NoError(t, err)
+	}
+
+	// export
+	var buf bytes.Buffer
+	require.NoError(t, store.ExportClientCSV(client, &buf))
+
+	// check
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, len(parcels)+1)
+	require.Equal(t, []string{"number", "client", "status", "address", "created_at"}, records[0])
+	for i, p := range parcels {
+		require.Equal(t, []string{
+			strconv.Itoa(p.Number),
+			strconv.Itoa(client),
+			string(p.Status),
+			p.Address,
+			p.CreatedAt,
+		}, records[i+1])
+	}
+
+	// у клиента без посылок — только заголовок
+	buf.Reset()
+	require.NoError(t, store.ExportClientCSV(-1, &buf))
+	require.Equal(t, "number,client,status,address,created_at\n", buf.String())
+
+	// ошибка записи возвращается вызывающему
+	err = store.ExportClientCSV(client, failingWriter{})
+	require.ErrorIs(t, err, errWriteFailed)
+}
+
+// TestImportCSV проверяет загрузку посылок из CSV
+func TestImportCSV(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	data := "number,client,status,address,created_at\n" +
+		fmt.Sprintf("1,%d,registered,test,2024-01-02T03:04:05Z\n", client) +
+		fmt.Sprintf("999,%d,sent,\"Москва, ул. \"\"Ленина\"\", д. 1\",2024-01-02T06:04:05+03:00\n", client)
+
+	// import
+	imported, err := store.ImportCSV(strings.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, 2, imported)
+
+	// check
+	stored, err := store.GetByClient(client)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	require.Equal(t, ParcelStatusRegistered, stored[0].Status)
+	require.Equal(t, "test", stored[0].Address)
+	require.Equal(t, ParcelStatusSent, stored[1].Status)
+	require.Equal(t, "Москва, ул. \"Ленина\", д. 1", stored[1].Address)
+	require.Equal(t, "2024-01-02T03:04:05Z", stored[1].CreatedAt)
+	// номер из файла игнорируется
+	require.NotEqual(t, 999, stored[1].Number)
+
+	// выгрузка и загрузка обратно дают те же посылки
+	var buf bytes.Buffer
+	require.NoError(t, store.ExportClientCSV(client, &buf))
+	imported, err = store.ImportCSV(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, imported)
+}
+
+// TestImportCSVMalformed проверяет, что некорректная строка отменяет всю загрузку
+func TestImportCSVMalformed(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	header := "number,client,status,address,created_at\n"
+	good := fmt.Sprintf(",%d,registered,test,\n", client)
+	tests := map[string]struct {
+		row  string
+		want string
+	}{
+		"bad client":     {",abc,registered,test,\n", `line 3: invalid client "abc"`},
+		"unknown status": {fmt.Sprintf(",%d,registerd,test,\n", client), "line 3: unknown parcel status"},
+		"bad timestamp":  {fmt.Sprintf(",%d,sent,test,yesterday\n", client), `line 3: invalid timestamp "yesterday"`},
+		"missing field":  {fmt.Sprintf(",%d,sent,test\n", client), "line 3"},
+		"empty address":  {fmt.Sprintf(",%d,sent, ,\n", client), "line 3: invalid parcel: empty address"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			imported, err := store.ImportCSV(strings.NewReader(header + good + tt.row))
+			require.ErrorIs(t, err, ErrMalformedCSV)
+			require.ErrorContains(t, err, tt.want)
+			require.Zero(t, imported)
+
+			// корректная строка перед ошибочной тоже не добавлена
+			count, err := store.CountByClient(client)
+			require.NoError(t, err)
+			require.Zero(t, count)
+		})
+	}
+}
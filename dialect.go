@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Dialect — диалект SQL базы данных, с которой работает хранилище
+type Dialect int
+
+const (
+	// DialectSQLite — SQLite, диалект по умолчанию
+	DialectSQLite Dialect = iota
+	// DialectPostgres — PostgreSQL (драйверы lib/pq и pgx)
+	DialectPostgres
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectSQLite:
+		return "sqlite"
+	case DialectPostgres:
+		return "postgres"
+	}
+	return fmt.Sprintf("Dialect(%d)", int(d))
+}
+
+// detectDialect определяет диалект по драйверу, через который открыта db.
+// Если драйвер не распознан, используется SQLite.
+func detectDialect(db *sql.DB) Dialect {
+	if db == nil {
+		return DialectSQLite
+	}
+	switch driver := fmt.Sprintf("%T", db.Driver()); {
+	case strings.HasPrefix(driver, "*pq."), strings.HasPrefix(driver, "*stdlib."):
+		return DialectPostgres
+	}
+	return DialectSQLite
+}
+
+// wrap возвращает querier, который переписывает запросы под диалект.
+// Запросы в хранилище пишутся с именованными параметрами (:name) и sql.Named
+// или, реже, с позиционными (?); SQLite понимает и те и другие как есть.
+func (d Dialect) wrap(q querier) querier {
+	if d == DialectPostgres {
+		return postgresQuerier{q: q}
+	}
+	return q
+}
+
+// postgresQuerier переписывает параметры :name и ? в позиционные ($1, $2, ...),
+// так как драйверы PostgreSQL не поддерживают ни sql.Named, ни ?
+type postgresQuerier struct {
+	q querier
+}
+
+func (p postgresQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	query, args, err := rebindPostgres(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return p.q.ExecContext(ctx, query, args...)
+}
+
+func (p postgresQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	query, args, err := rebindPostgres(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return p.q.QueryContext(ctx, query, args...)
+}
+
+func (p postgresQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	// *sql.Row нельзя создать с ошибкой, поэтому при ошибке запрос уходит как есть:
+	// драйвер отклонит sql.Named, и ошибка вернётся из Scan
+	if rebound, rebArgs, err := rebindPostgres(query, args); err == nil {
+		query, args = rebound, rebArgs
+	}
+	return p.q.QueryRowContext(ctx, query, args...)
+}
+
+// rebindPostgres заменяет параметры :name на $1, $2, ... и раскладывает sql.Named
+// аргументы по позициям. Один и тот же параметр получает один и тот же номер.
+// Текст в одинарных кавычках и приведения типов (::text) не затрагиваются.
+// Если среди аргументов нет sql.NamedArg, параметры ? заменяются на $1, $2, ...
+// по порядку, а аргументы передаются как есть.
+func rebindPostgres(query string, args []any) (string, []any, error) {
+	named := map[string]any{}
+	for _, arg := range args {
+		na, ok := arg.(sql.NamedArg)
+		if !ok {
+			return rebindPositional(query), args, nil
+		}
+		named[na.Name] = na.Value
+	}
+	if len(named) == 0 {
+		return rebindPositional(query), args, nil
+	}
+
+	var (
+		b         strings.Builder
+		positions = map[string]int{}
+		res       []any
+		inString  bool
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+		case inString:
+		case c == ':' && i+1 < len(query) && query[i+1] == ':':
+			// приведение типа ::type
+			b.WriteString("::")
+			i++
+			continue
+		case c == ':' && i+1 < len(query) && isIdentStart(query[i+1]):
+			j := i + 1
+			for j < len(query) && isIdentChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			pos, ok := positions[name]
+			if !ok {
+				value, ok := named[name]
+				if !ok {
+					return "", nil, fmt.Errorf("missing argument for parameter :%s", name)
+				}
+				res = append(res, value)
+				pos = len(res)
+				positions[name] = pos
+			}
+			fmt.Fprintf(&b, "$%d", pos)
+			i = j - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), res, nil
+}
+
+// rebindPositional заменяет параметры ? на $1, $2, ... по порядку.
+// Текст в одинарных кавычках не затрагивается.
+func rebindPositional(query string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+
+	var (
+		b        strings.Builder
+		n        int
+		inString bool
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+		case c == '?' && !inString:
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
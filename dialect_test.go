@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestRebindPostgres проверяет замену именованных параметров на позиционные
+func TestRebindPostgres(t *testing.T) {
+	query, args, err := rebindPostgres(
+		"UPDATE parcel SET status = :status WHERE number = :number AND status <> :status",
+		[]any{sql.Named("number", 1), sql.Named("status", "sent")})
+	require.NoError(t, err)
+	require.Equal(t, "UPDATE parcel SET status = $1 WHERE number = $2 AND status <> $1", query)
+	require.Equal(t, []any{"sent", 1}, args)
+
+	_, _, err = rebindPostgres("SELECT * FROM parcel WHERE number = :number", []any{sql.Named("client", 1)})
+	require.Error(t, err)
+
+	// позиционные параметры нумеруются по порядку, текст в кавычках не меняется
+	query, args, err = rebindPostgres(
+		"UPDATE parcel SET address = ? WHERE number = ? AND client = ? AND address <> '?'",
+		[]any{"new", 1, 1000})
+	require.NoError(t, err)
+	require.Equal(t, "UPDATE parcel SET address = $1 WHERE number = $2 AND client = $3 AND address <> '?'", query)
+	require.Equal(t, []any{"new", 1, 1000}, args)
+
+	// запрос без параметров
+	query, args, err = rebindPostgres("SELECT COUNT(*) FROM parcel", nil)
+	require.NoError(t, err)
+	require.Equal(t, "SELECT COUNT(*) FROM parcel", query)
+	require.Empty(t, args)
+}
+
+// TestWrapSQLite проверяет, что для SQLite запросы не переписываются
+func TestWrapSQLite(t *testing.T) {
+	db := newTestDB(t)
+
+	q := DialectSQLite.wrap(db)
+	require.Same(t, db, q)
+
+	// и ?, и :name выполняются как есть
+	var n int
+	require.NoError(t, q.QueryRowContext(context.Background(), "SELECT ? + :b", 1, sql.Named("b", 2)).Scan(&n))
+	require.Equal(t, 3, n)
+}
+
+// TestDetectDialect проверяет определение диалекта по драйверу
+func TestDetectDialect(t *testing.T) {
+	db := newTestDB(t)
+
+	require.Equal(t, DialectSQLite, detectDialect(db))
+	require.Equal(t, DialectSQLite, NewParcelStore(db).dialect)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// wrapErr сводит ошибку драйвера базы к одной из общих категорий, чтобы
+// вызывающий мог разобрать её через errors.Is одинаково для SQLite и
+// PostgreSQL: sql.ErrNoRows — к ErrParcelNotFound, нарушение ограничения —
+// к ErrConstraintViolation, занятую базу и конфликт транзакций — к ErrBusy,
+// обрыв или отсутствие соединения — к ErrConnection. Исходная ошибка
+// сохраняется в цепочке. Остальные ошибки, в том числе уже разобранные
+// хранилищем, возвращаются без изменений. Вызывается из observe, так что
+// через неё проходят ошибки всех методов хранилища.
+func wrapErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	category := classifyErr(err)
+	if category == nil || errors.Is(err, category) {
+		return err
+	}
+	return fmt.Errorf("%s: %w: %w", op, category, err)
+}
+
+// classifyErr возвращает категорию ошибки драйвера для wrapErr или nil
+func classifyErr(err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrParcelNotFound
+	case isConstraintViolation(err):
+		return ErrConstraintViolation
+	case isRetryable(err):
+		return ErrBusy
+	case isConnectionError(err):
+		return ErrConnection
+	}
+	return nil
+}
+
+// isConstraintViolation сообщает, что запрос нарушил ограничение схемы:
+// первичный ключ, уникальный индекс, NOT NULL или CHECK
+func isConstraintViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqlite3.SQLITE_CONSTRAINT
+	}
+
+	// класс 23 — integrity_constraint_violation
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.SQLState(), "23")
+	}
+	return false
+}
+
+// isConnectionError сообщает, что с базой нет соединения: она закрыта,
+// не открывается или соединение оборвалось
+func isConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_CANTOPEN, sqlite3.SQLITE_NOTADB:
+			return true
+		}
+		return false
+	}
+
+	// класс 08 — connection_exception
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.SQLState(), "08")
+	}
+
+	// database/sql не экспортирует ошибку закрытой базы
+	return strings.Contains(err.Error(), "sql: database is closed")
+}
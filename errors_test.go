@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pgError имитирует ошибку драйвера PostgreSQL с кодом SQLSTATE
+type pgError struct {
+	code string
+}
+
+func (e pgError) Error() string    { return "pq: error " + e.code }
+func (e pgError) SQLState() string { return e.code }
+
+// TestWrapErr проверяет разбор ошибок драйверов по категориям
+func TestWrapErr(t *testing.T) {
+	// prepare: настоящая ошибка SQLite о нарушении первичного ключа
+	store := newTestStore(t)
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, sqliteErr := store.db.Exec(`INSERT INTO "parcel" (number, client, status, address, created_at) VALUES (?, 1, 'registered', 'test', '')`, num)
+	require.Error(t, sqliteErr)
+
+	tests := map[string]struct {
+		err  error
+		want error
+	}{
+		"no rows":           {sql.ErrNoRows, ErrParcelNotFound},
+		"sqlite constraint": {sqliteErr, ErrConstraintViolation},
+		"pg unique":         {pgError{"23505"}, ErrConstraintViolation},
+		"pg not null":       {pgError{"23502"}, ErrConstraintViolation},
+		"sqlite locked":     {errors.New("database is locked (5) (SQLITE_BUSY)"), ErrBusy},
+		"pg serialization":  {pgError{"40001"}, ErrBusy},
+		"bad conn":          {driver.ErrBadConn, ErrConnection},
+		"conn done":         {sql.ErrConnDone, ErrConnection},
+		"network":           {&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrConnection},
+		"pg connection":     {pgError{"08006"}, ErrConnection},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := wrapErr("Get", tt.err)
+			require.ErrorIs(t, err, tt.want)
+			// исходная ошибка сохраняется
+			require.ErrorIs(t, err, tt.err)
+			require.Contains(t, err.Error(), "Get: ")
+		})
+	}
+
+	// неизвестные и уже разобранные ошибки не меняются
+	other := errors.New("other")
+	require.Equal(t, other, wrapErr("Get", other))
+	require.Equal(t, ErrParcelNotFound, wrapErr("Get", ErrParcelNotFound))
+	require.NoError(t, wrapErr("Get", nil))
+}
+
+// TestWrapErrStore проверяет, что методы хранилища возвращают разобранные ошибки
+func TestWrapErrStore(t *testing.T) {
+	// база не открывается: каталога нет
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "missing", "tracker.db"))
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = NewParcelStore(db).Get(1)
+	require.ErrorIs(t, err, ErrConnection)
+
+	// база закрыта
+	db = newTestDB(t)
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+	require.NoError(t, db.Close())
+	_, err = store.Get(1)
+	require.ErrorIs(t, err, ErrConnection)
+
+	// база заблокирована другим соединением
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err = sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+	store = NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	unlock := lockDB(t, path)
+	_, err = store.Add(getTestParcel())
+	require.ErrorIs(t, err, ErrBusy)
+	require.NoError(t, unlock())
+}
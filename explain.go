@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Методы Explain* — диагностические: они возвращают план выполнения
+// (EXPLAIN QUERY PLAN) запросов хранилища, чтобы при разборе медленных
+// запросов проверить, используются ли индексы. Поддерживается только SQLite;
+// формат плана зависит от версии SQLite и не предназначен для разбора.
+
+// ExplainGetByClient возвращает план запроса GetByClient для клиента client
+func (s ParcelStore) ExplainGetByClient(client int) (plan string, err error) {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ExplainGetByClient", start, err, slog.Int("client", client)) }()
+
+	return s.explain(ctx, s.getByClientQuery(), sql.Named("client", client))
+}
+
+// ExplainStatusCountsByClient возвращает план запроса StatusCountsByClient
+// для клиента client
+func (s ParcelStore) ExplainStatusCountsByClient(client int) (plan string, err error) {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ExplainStatusCountsByClient", start, err, slog.Int("client", client)) }()
+
+	return s.explain(ctx, s.statusCountsByClientQuery(), sql.Named("client", client))
+}
+
+// explain выполняет EXPLAIN QUERY PLAN для query и возвращает шаги плана по
+// одному в строке; вложенные шаги сдвинуты отступом
+func (s ParcelStore) explain(ctx context.Context, query string, args ...any) (string, error) {
+	if s.dialect != DialectSQLite {
+		return "", errors.New("query plans are only supported for SQLite")
+	}
+
+	rows, err := s.conn().QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	depth := map[int]int{}
+	for rows.Next() {
+		var (
+			id, parent, notUsed int
+			detail              string
+		)
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			return "", err
+		}
+		depth[id] = depth[parent] + 1
+		b.WriteString(strings.Repeat("  ", depth[id]-1))
+		b.WriteString(detail)
+		b.WriteByte('\n')
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestExplain проверяет, что запросы по клиенту используют индекс по client
+func TestExplain(t *testing.T) {
+	// prepare
+	h := &recordHandler{}
+	store := newTestStore(t, WithLogger(slog.New(h)))
+
+	// check
+	plan, err := store.ExplainGetByClient(1000)
+	require.NoError(t, err)
+	require.Contains(t, plan, "USING INDEX parcel_client_idx")
+
+	plan, err = store.ExplainStatusCountsByClient(1000)
+	require.NoError(t, err)
+	require.Contains(t, plan, "USING INDEX parcel_client_idx")
+
+	// методы Explain пишутся в журнал, как и остальные
+	for _, op := range []string{"ExplainGetByClient", "ExplainStatusCountsByClient"} {
+		attrs, ok := h.find(slog.LevelDebug, op)
+		require.True(t, ok, op)
+		require.Equal(t, int64(1000), attrs["client"].Int64())
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+)
+
+// Поля посылки, изменения которых записываются в историю
+const (
+	HistoryFieldStatus  = "status"
+	HistoryFieldAddress = "address"
+	HistoryFieldClient  = "client"
+	// HistoryFieldDeleted записывается при удалении посылки, в том числе мягком
+	// и массовом: старое значение "false", новое "true". При окончательном
+	// удалении помеченной посылки (PurgeDeletedBefore) — "true" и "purged".
+	HistoryFieldDeleted = "deleted"
+)
+
+// HistoryEntry — запись истории изменений посылки
+type HistoryEntry struct {
+	Number    int    `json:"number"`
+	Field     string `json:"field"`
+	OldValue  string `json:"old_value"`
+	NewValue  string `json:"new_value"`
+	ChangedAt string `json:"changed_at"`
+}
+
+// History возвращает историю изменений посылки в порядке их выполнения.
+// История хранится и после удаления посылки. Если изменений не было,
+// возвращается пустой срез.
+func (s ParcelStore) History(number int) ([]HistoryEntry, error) {
+	return s.HistoryContext(context.Background(), number)
+}
+
+func (s ParcelStore) HistoryContext(ctx context.Context, number int) (_ []HistoryEntry, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "History", start, err, slog.Int("number", number)) }()
+
+	return s.history(ctx, s.conn(), number)
+}
+
+// GetWithHistory возвращает посылку вместе с историей её изменений. Оба запроса
+// выполняются в одной транзакции, поэтому история соответствует возвращённому
+// состоянию посылки. Если посылки нет, возвращается ErrParcelNotFound.
+func (s ParcelStore) GetWithHistory(number int) (Parcel, []HistoryEntry, error) {
+	return s.GetWithHistoryContext(context.Background(), number)
+}
+
+func (s ParcelStore) GetWithHistoryContext(ctx context.Context, number int) (p Parcel, history []HistoryEntry, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetWithHistory", start, err, slog.Int("number", number)) }()
+
+	// runTx, а не inTx: операция только читает, поэтому не повторяется
+	// и доступна в режиме WithReadOnly
+	err = s.runTx(ctx, func(tx querier) error {
+		var err error
+		if p, err = s.getParcel(ctx, tx, number); err != nil {
+			return err
+		}
+		history, err = s.history(ctx, tx, number)
+		return err
+	})
+	if err != nil {
+		return Parcel{}, nil, err
+	}
+	return p, history, nil
+}
+
+// history читает историю изменений посылки через q
+func (s ParcelStore) history(ctx context.Context, q querier, number int) ([]HistoryEntry, error) {
+	res := []HistoryEntry{}
+	rows, err := q.QueryContext(ctx,
+		"SELECT number, field, old_value, new_value, changed_at FROM "+s.historyTable()+
+			" WHERE number = :number ORDER BY id",
+		sql.Named("number", number))
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.Number, &e.Field, &e.OldValue, &e.NewValue, &e.ChangedAt); err != nil {
+			return res, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// addHistory записывает изменение поля посылки в историю. Вызывается в той же
+// транзакции, что и само изменение.
+func (s ParcelStore) addHistory(ctx context.Context, tx querier, number int, field, oldValue, newValue string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO "+s.historyTable()+` (number, field, old_value, new_value, changed_at)
+		VALUES (:number, :field, :old_value, :new_value, :changed_at)`,
+		sql.Named("number", number),
+		sql.Named("field", field),
+		sql.Named("old_value", oldValue),
+		sql.Named("new_value", newValue),
+		sql.Named("changed_at", s.now()))
+	return err
+}
+
+// historyTable возвращает имя таблицы истории для таблицы посылок,
+// готовое к подстановке в запрос
+func (s ParcelStore) historyTable() string {
+	return quoteIdent(s.table + "_history")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// jsonlFlushEvery — через сколько строк ExportJSONL сбрасывает буфер в w
+const jsonlFlushEvery = 100
+
+// ExportJSONL записывает все посылки в w в формате JSON Lines: по одному объекту
+// на строку, в порядке номеров. Посылки читаются из базы по одной, так что память
+// не зависит от их числа, а буфер сбрасывается в w каждые jsonlFlushEvery строк.
+// При отмене ctx экспорт прерывается, и уже записанные строки остаются в w.
+func (s ParcelStore) ExportJSONL(ctx context.Context, w io.Writer) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	var exported int
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ExportJSONL", start, err, slog.Int("exported", exported)) }()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = iterParcels(ctx, s.conn(), func(p Parcel) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(p); err != nil {
+			return err
+		}
+		exported++
+		if exported%jsonlFlushEvery == 0 {
+			return bw.Flush()
+		}
+		return nil
+	}, "SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number")
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
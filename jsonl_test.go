@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestExportJSONL проверяет выгрузку посылок в формате JSON Lines
+func TestExportJSONL(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// больше jsonlFlushEvery, чтобы буфер сбрасывался посреди выгрузки
+	parcels := make([]Parcel, jsonlFlushEvery+5)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+	}
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+
+	// export
+	var buf bytes.Buffer
+	require.NoError(t, store.ExportJSONL(context.Background(), &buf))
+
+	// check
+	var got []int
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var p Parcel
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &p))
+		require.NoError(t, p.Validate())
+		got = append(got, p.Number)
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, numbers, got)
+
+	// отменённый контекст
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = store.ExportJSONL(ctx, &bytes.Buffer{})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -2,31 +2,220 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
 	"time"
+	"unicode"
 
 	_ "modernc.org/sqlite"
 )
 
+// ParcelStatus — статус посылки
+type ParcelStatus string
+
 const (
-	ParcelStatusRegistered = "registered"
-	ParcelStatusSent       = "sent"
-	ParcelStatusDelivered  = "delivered"
+	ParcelStatusRegistered ParcelStatus = "registered"
+	ParcelStatusSent       ParcelStatus = "sent"
+	ParcelStatusDelivered  ParcelStatus = "delivered"
+	ParcelStatusReturned   ParcelStatus = "returned"
+	// ParcelStatusExpired — посылка слишком долго не отправлялась (см. ExpireStale)
+	ParcelStatusExpired ParcelStatus = "expired"
 )
 
+// parcelStatuses — полный список допустимых статусов посылки
+var parcelStatuses = []ParcelStatus{
+	ParcelStatusRegistered,
+	ParcelStatusSent,
+	ParcelStatusDelivered,
+	ParcelStatusReturned,
+	ParcelStatusExpired,
+}
+
+// Valid сообщает, является ли s одним из допустимых статусов посылки
+func (s ParcelStatus) Valid() bool {
+	for _, status := range parcelStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidStatus сообщает, является ли status одним из допустимых статусов посылки.
+// Оставлена для совместимости; в новом коде удобнее ParcelStatus.Valid.
+func IsValidStatus(status string) bool {
+	return ParcelStatus(status).Valid()
+}
+
+// ParseStatus преобразует строку в статус посылки. Для неизвестного статуса
+// возвращается ErrUnknownStatus.
+func ParseStatus(s string) (ParcelStatus, error) {
+	status := ParcelStatus(s)
+	if !status.Valid() {
+		return "", fmt.Errorf("%w: %q", ErrUnknownStatus, s)
+	}
+	return status, nil
+}
+
 type Parcel struct {
-	Number    int
-	Client    int
-	Status    string
-	Address   string
-	CreatedAt string
+	Number    int          `json:"number"`
+	Client    int          `json:"client"`
+	Status    ParcelStatus `json:"status"`
+	Address   string       `json:"address"`
+	CreatedAt string       `json:"created_at"`
+	UpdatedAt string       `json:"updated_at"`
+	// Version увеличивается при каждом изменении посылки; новая посылка получает версию 1
+	Version int `json:"version"`
+	// ShippedAt — время перевода посылки в статус sent; пусто, пока посылка не отправлена
+	ShippedAt string `json:"shipped_at"`
+	// DeliveredAt — время перевода посылки в статус delivered; пусто, пока посылка не доставлена
+	DeliveredAt string `json:"delivered_at"`
+	// IdempotencyKey — необязательный ключ, задаваемый клиентом: повторный Add
+	// с тем же ключом для того же клиента возвращает номер уже добавленной посылки
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Weight — вес посылки в граммах
+	Weight float64 `json:"weight"`
+	// Metadata — произвольные пары «ключ — значение» клиента (например, пометка
+	// «хрупкое» или номер у перевозчика). Хранится в базе как JSON; nil и пустая
+	// карта хранятся одинаково, и при чтении такой посылки Metadata равна nil.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Attempts — количество неудачных попыток доставки (см. RecordDeliveryAttempt)
+	Attempts int `json:"attempts"`
+	// DeliverAfter и DeliverBefore — предпочтительное окно доставки в RFC3339;
+	// любой край может быть не задан (пустая строка, в базе — NULL)
+	DeliverAfter  string `json:"deliver_after,omitempty"`
+	DeliverBefore string `json:"deliver_before,omitempty"`
+}
+
+// Validate проверяет поля посылки перед добавлением: клиент должен быть
+// положительным, адрес — непустым, статус — одним из известных, а окно
+// доставки, если задано, — в RFC3339 и с началом раньше конца.
+// Ошибка оборачивает ErrInvalidParcel.
+func (p Parcel) Validate() error {
+	if p.Client <= 0 {
+		return fmt.Errorf("%w: client must be positive, got %d", ErrInvalidParcel, p.Client)
+	}
+	if strings.TrimSpace(p.Address) == "" {
+		return fmt.Errorf("%w: empty address", ErrInvalidParcel)
+	}
+	if !p.Status.Valid() {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidParcel, p.Status)
+	}
+	if p.Weight < 0 || math.IsNaN(p.Weight) || math.IsInf(p.Weight, 0) {
+		return fmt.Errorf("%w: weight must be non-negative, got %v", ErrInvalidParcel, p.Weight)
+	}
+
+	var window [2]time.Time
+	for i, ts := range []string{p.DeliverAfter, p.DeliverBefore} {
+		if ts == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return fmt.Errorf("%w: invalid delivery window timestamp %q", ErrInvalidParcel, ts)
+		}
+		window[i] = t
+	}
+	if p.DeliverAfter != "" && p.DeliverBefore != "" {
+		if err := checkDeliveryWindow(&window[0], &window[1]); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidParcel, err)
+		}
+	}
+	return nil
+}
+
+// checkDeliveryWindow проверяет, что начало окна доставки раньше конца.
+// Окно, у которого не задан хотя бы один край, допустимо.
+func checkDeliveryWindow(after, before *time.Time) error {
+	if after != nil && before != nil && !after.Before(*before) {
+		return fmt.Errorf("%w: %s is not before %s", ErrInvalidDeliveryWindow,
+			after.Format(time.RFC3339), before.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// normalizeTimestamps приводит заданные вызывающим отметки времени посылки
+// (создание, изменение, края окна доставки) к формату хранения — RFC3339
+// в UTC. Методы выборки сравнивают время как строки, поэтому время в другом
+// часовом поясе или формате нарушило бы порядок. Пустые отметки остаются
+// пустыми; для отметки не в RFC3339 возвращается ошибка с ErrInvalidParcel.
+func (p *Parcel) normalizeTimestamps() error {
+	for _, ts := range []*string{&p.CreatedAt, &p.UpdatedAt, &p.DeliverAfter, &p.DeliverBefore} {
+		normalized, err := normalizeTimestamp(*ts)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidParcel, err)
+		}
+		*ts = normalized
+	}
+	return nil
+}
+
+// NormalizeAddress приводит адрес к виду, в котором он хранится: убирает
+// управляющие символы и пробелы по краям, а идущие подряд пробельные символы
+// заменяет одним пробелом. Регистр не меняется.
+func NormalizeAddress(address string) string {
+	address = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, address)
+	return strings.Join(strings.Fields(address), " ")
+}
+
+// MarshalJSON сериализует посылку, приводя отметки времени к RFC3339 в UTC.
+// Если отметка времени задана не в RFC3339, возвращается ошибка.
+func (p Parcel) MarshalJSON() ([]byte, error) {
+	// parcel не наследует MarshalJSON, поэтому json.Marshal не уйдёт в рекурсию
+	type parcel Parcel
+	out := parcel(p)
+
+	var err error
+	if out.CreatedAt, err = normalizeTimestamp(p.CreatedAt); err != nil {
+		return nil, err
+	}
+	if out.UpdatedAt, err = normalizeTimestamp(p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if out.ShippedAt, err = normalizeTimestamp(p.ShippedAt); err != nil {
+		return nil, err
+	}
+	if out.DeliveredAt, err = normalizeTimestamp(p.DeliveredAt); err != nil {
+		return nil, err
+	}
+	if out.DeliverAfter, err = normalizeTimestamp(p.DeliverAfter); err != nil {
+		return nil, err
+	}
+	if out.DeliverBefore, err = normalizeTimestamp(p.DeliverBefore); err != nil {
+		return nil, err
+	}
+	return json.Marshal(out)
+}
+
+// normalizeTimestamp приводит отметку времени в формате RFC3339 к UTC.
+// Пустая строка остаётся пустой.
+func normalizeTimestamp(ts string) (string, error) {
+	if ts == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q: %w", ts, err)
+	}
+	return t.UTC().Format(time.RFC3339), nil
 }
 
 type ParcelService struct {
-	store ParcelStore
+	store Store
 }
 
-func NewParcelService(store ParcelStore) ParcelService {
+func NewParcelService(store Store) ParcelService {
 	return ParcelService{store: store}
 }
 
@@ -73,13 +262,13 @@ func (s ParcelService) NextStatus(number int) error {
 		return err
 	}
 
-	var nextStatus string
+	var nextStatus ParcelStatus
 	switch parcel.Status {
 	case ParcelStatusRegistered:
 		nextStatus = ParcelStatusSent
 	case ParcelStatusSent:
 		nextStatus = ParcelStatusDelivered
-	case ParcelStatusDelivered:
+	case ParcelStatusDelivered, ParcelStatusReturned, ParcelStatusExpired:
 		return nil
 	}
 
@@ -104,6 +293,11 @@ func main() {
 	}
 	defer db.Close()
 	store := NewParcelStore(db)
+	defer store.Close()
+	if err := store.Migrate(); err != nil {
+		fmt.Println(err)
+		return
+	}
 	service := NewParcelService(store)
 
 	// регистрация посылки
@@ -139,7 +333,9 @@ func main() {
 
 	// попытка удаления отправленной посылки
 	err = service.Delete(p.Number)
-	if err != nil {
+	if errors.Is(err, ErrDeleteNotAllowed) {
+		fmt.Printf("Посылку № %d нельзя удалить, т.к. её статус НЕ «зарегистрирована»\n", p.Number)
+	} else if err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore — реализация Store в памяти, без базы данных. Предназначена для
+// тестов кода, зависящего от Store: номера выдаются по возрастанию с 1, ошибки
+// и правила смены статуса и адреса те же, что у ParcelStore. Безопасна для
+// конкурентного использования.
+type MemoryStore struct {
+	mu      sync.Mutex
+	parcels map[int]Parcel
+	last    int
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore возвращает пустое хранилище в памяти
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{parcels: map[int]Parcel{}}
+}
+
+func (m *MemoryStore) Add(p Parcel) (int, error) {
+	p.Address = NormalizeAddress(p.Address)
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+	if err := checkAddressLength(p.Address, defaultMaxAddressLength); err != nil {
+		return 0, err
+	}
+	if err := p.normalizeTimestamps(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p.IdempotencyKey != "" {
+		for _, existing := range m.parcels {
+			if existing.Client == p.Client && existing.IdempotencyKey == p.IdempotencyKey {
+				return existing.Number, nil
+			}
+		}
+	}
+	if p.CreatedAt == "" {
+		p.CreatedAt = formatTime(time.Now())
+	}
+	if p.UpdatedAt == "" {
+		p.UpdatedAt = p.CreatedAt
+	}
+	if p.Number > 0 {
+		if _, ok := m.parcels[p.Number]; ok {
+			return 0, fmt.Errorf("parcel %d: %w", p.Number, ErrDuplicateNumber)
+		}
+		m.last = max(m.last, p.Number)
+	} else {
+		m.last++
+		p.Number = m.last
+	}
+	p.Version = 1
+	p.ShippedAt, p.DeliveredAt = "", ""
+	// метаданные копируются, а пустые хранятся как nil, как в ParcelStore
+	p.Metadata = maps.Clone(p.Metadata)
+	if len(p.Metadata) == 0 {
+		p.Metadata = nil
+	}
+	m.parcels[p.Number] = p
+	return p.Number, nil
+}
+
+func (m *MemoryStore) Get(number int) (Parcel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.get(number)
+}
+
+// GetByClient возвращает посылки клиента, упорядоченные по номеру
+func (m *MemoryStore) GetByClient(client int) ([]Parcel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := []Parcel{}
+	for _, p := range m.parcels {
+		if p.Client == client {
+			res = append(res, p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Number < res[j].Number })
+	return res, nil
+}
+
+func (m *MemoryStore) SetStatus(number int, status ParcelStatus) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.get(number)
+	if err != nil {
+		return err
+	}
+	if !canTransition(p.Status, status) {
+		return fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, p.Status, status)
+	}
+
+	p.Status = status
+	m.touch(&p)
+	switch status {
+	case ParcelStatusSent:
+		p.ShippedAt = p.UpdatedAt
+	case ParcelStatusDelivered:
+		p.DeliveredAt = p.UpdatedAt
+	}
+	m.parcels[number] = p
+	return nil
+}
+
+// SetAddress, как и ParcelStore.SetAddress, молча не меняет адрес посылки
+// не в статусе registered и не перезаписывает посылку, если адрес тот же
+func (m *MemoryStore) SetAddress(number int, address string) error {
+	address = NormalizeAddress(address)
+	if err := checkAddressLength(address, defaultMaxAddressLength); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.get(number)
+	if err != nil {
+		return err
+	}
+	if p.Status != ParcelStatusRegistered || p.Address == address {
+		return nil
+	}
+
+	p.Address = address
+	m.touch(&p)
+	m.parcels[number] = p
+	return nil
+}
+
+func (m *MemoryStore) Delete(number int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := m.get(number)
+	if err != nil {
+		return err
+	}
+	if p.Status != ParcelStatusRegistered {
+		return fmt.Errorf("parcel %d in status %s: %w", number, p.Status, ErrDeleteNotAllowed)
+	}
+	delete(m.parcels, number)
+	return nil
+}
+
+// get возвращает посылку или ErrParcelNotFound. Вызывается под m.mu.
+func (m *MemoryStore) get(number int) (Parcel, error) {
+	p, ok := m.parcels[number]
+	if !ok {
+		return Parcel{}, fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+	}
+	return p, nil
+}
+
+// touch отмечает изменение посылки: обновляет время и увеличивает версию
+func (m *MemoryStore) touch(p *Parcel) {
+	p.UpdatedAt = formatTime(time.Now())
+	p.Version++
+}
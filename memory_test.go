@@ -0,0 +1,163 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStoreParity проверяет, что ParcelStore и MemoryStore ведут себя одинаково
+func TestStoreParity(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store {
+			return newTestStore(t)
+		},
+		"memory": func(t *testing.T) Store {
+			return NewMemoryStore()
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, newStore(t))
+		})
+	}
+}
+
+// testStore проверяет поведение реализации Store на пустом хранилище
+func testStore(t *testing.T, store Store) {
+	// add
+	parcel := getTestParcel()
+	parcel.Address = "  test   address "
+	first, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.Equal(t, 1, first)
+	second, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.Equal(t, 2, second)
+
+	// повторное добавление с тем же ключом идемпотентности
+	keyed := getTestParcel()
+	keyed.Client = 2000
+	keyed.IdempotencyKey = "key"
+	keyedNum, err := store.Add(keyed)
+	require.NoError(t, err)
+	require.Equal(t, 3, keyedNum)
+	keyedNum, err = store.Add(keyed)
+	require.NoError(t, err)
+	require.Equal(t, 3, keyedNum)
+
+	_, err = store.Add(Parcel{Client: 0, Status: ParcelStatusRegistered, Address: "test"})
+	require.ErrorIs(t, err, ErrInvalidParcel)
+
+	// get
+	got, err := store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, parcel.Client, got.Client)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	require.Equal(t, "test address", got.Address)
+	require.Equal(t, parcel.CreatedAt, got.CreatedAt)
+	require.Equal(t, 1, got.Version)
+
+	_, err = store.Get(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// get by client
+	byClient, err := store.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Len(t, byClient, 2)
+	require.Equal(t, first, byClient[0].Number)
+	require.Equal(t, second, byClient[1].Number)
+
+	byClient, err = store.GetByClient(-1)
+	require.NoError(t, err)
+	require.NotNil(t, byClient)
+	require.Empty(t, byClient)
+
+	// set address
+	require.NoError(t, store.SetAddress(first, "new address"))
+	got, err = store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, "new address", got.Address)
+	require.Equal(t, 2, got.Version)
+	require.ErrorIs(t, store.SetAddress(-1, "new address"), ErrParcelNotFound)
+
+	// слишком длинный адрес и повторная установка того же адреса
+	longAddress := strings.Repeat("a", defaultMaxAddressLength+1)
+	require.ErrorIs(t, store.SetAddress(first, longAddress), ErrAddressTooLong)
+	require.NoError(t, store.SetAddress(first, "new address"))
+	got, err = store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, 2, got.Version)
+
+	// set status
+	require.ErrorIs(t, store.SetStatus(first, ParcelStatusDelivered), ErrInvalidStatusTransition)
+	require.ErrorIs(t, store.SetStatus(first, "lost"), ErrInvalidStatusTransition)
+	require.ErrorIs(t, store.SetStatus(-1, ParcelStatusSent), ErrParcelNotFound)
+	require.NoError(t, store.SetStatus(first, ParcelStatusSent))
+	got, err = store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, 3, got.Version)
+	require.NotEmpty(t, got.ShippedAt)
+
+	// адрес отправленной посылки молча не меняется
+	require.NoError(t, store.SetAddress(first, "other address"))
+	got, err = store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, "new address", got.Address)
+
+	// delete
+	require.ErrorIs(t, store.Delete(first), ErrDeleteNotAllowed)
+	require.ErrorIs(t, store.Delete(-1), ErrParcelNotFound)
+	require.NoError(t, store.Delete(second))
+	_, err = store.Get(second)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// номера удалённых посылок не выдаются повторно
+	fourth, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.Equal(t, 4, fourth)
+
+	// явно заданный номер
+	explicit := getTestParcel()
+	explicit.Number = 10
+	num, err := store.Add(explicit)
+	require.NoError(t, err)
+	require.Equal(t, 10, num)
+	_, err = store.Add(explicit)
+	require.ErrorIs(t, err, ErrDuplicateNumber)
+	next, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.Equal(t, 11, next)
+}
+
+// TestNextStatus проверяет, что NextStatus проводит посылку по статусам
+// и не меняет посылку в конечном статусе
+func TestNextStatus(t *testing.T) {
+	// prepare
+	store := NewMemoryStore()
+	service := NewParcelService(store)
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	expired, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(expired, ParcelStatusExpired))
+
+	// check: registered -> sent -> delivered, дальше статус не меняется
+	for _, want := range []ParcelStatus{ParcelStatusSent, ParcelStatusDelivered, ParcelStatusDelivered} {
+		require.NoError(t, service.NextStatus(num))
+		got, err := store.Get(num)
+		require.NoError(t, err)
+		require.Equal(t, want, got.Status)
+	}
+
+	// истёкшая посылка — тоже в конечном статусе
+	require.NoError(t, service.NextStatus(expired))
+	got, err := store.Get(expired)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusExpired, got.Status)
+	require.Equal(t, 2, got.Version)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MetricsCollector получает сведения о каждой операции хранилища: имя метода
+// (например, "Add"), длительность и ошибку. Через него метрики можно передать
+// в Prometheus или другую систему, не добавляя зависимостей в хранилище.
+// Методы вызываются конкурентно.
+type MetricsCollector interface {
+	ObserveOp(name string, dur time.Duration, err error)
+}
+
+// noopMetrics — сборщик по умолчанию, ничего не делает
+type noopMetrics struct{}
+
+func (noopMetrics) ObserveOp(string, time.Duration, error) {}
+
+// OpCounter — простой MetricsCollector, считающий операции и ошибки по имени
+// операции. Подходит для тестов и отладки.
+type OpCounter struct {
+	mu     sync.Mutex
+	calls  map[string]int
+	errors map[string]int
+}
+
+// NewOpCounter возвращает пустой OpCounter
+func NewOpCounter() *OpCounter {
+	return &OpCounter{calls: map[string]int{}, errors: map[string]int{}}
+}
+
+func (c *OpCounter) ObserveOp(name string, _ time.Duration, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls[name]++
+	if err != nil {
+		c.errors[name]++
+	}
+}
+
+// Calls возвращает количество вызовов операции name
+func (c *OpCounter) Calls(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[name]
+}
+
+// Errors возвращает количество вызовов операции name, завершившихся ошибкой
+func (c *OpCounter) Errors(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors[name]
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+)
+
+// maxLoggedText — сколько символов адреса или шаблона поиска попадает в журнал
+const maxLoggedText = 16
+
+// withTimeout ограничивает ctx временем WithQueryTimeout, если оно задано.
+// Вызывается в начале каждого метода хранилища вместе с observe:
+//
+//	ctx, cancel := s.withTimeout(ctx)
+//	defer cancel()
+//	start := time.Now()
+//	defer func() { err = s.observe(ctx, "Get", start, err, slog.Int("number", number)) }()
+func (s ParcelStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+// observe сообщает о завершённой операции хранилища сборщику метрик и пишет её
+// в журнал на уровне Debug: имя, длительность, ошибку (если была) и
+// дополнительные атрибуты. Операция дольше WithSlowQueryThreshold пишется
+// ещё и на уровне Warn. Вызывается отложенно в начале метода (см. withTimeout)
+// и возвращает ошибку операции. Если операция прервана отменой ctx или истечением
+// его срока, а драйвер вернул свою ошибку, она оборачивается в ctx.Err(), чтобы
+// вызывающий мог проверить её через errors.Is; остальные ошибки драйвера
+// разбираются wrapErr.
+func (s ParcelStore) observe(ctx context.Context, op string, start time.Time, err error, attrs ...slog.Attr) error {
+	if err != nil && ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+		err = fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+	err = wrapErr(op, err)
+
+	dur := time.Since(start)
+	s.metrics.ObserveOp(op, dur, err)
+
+	debug := s.logger.Enabled(ctx, slog.LevelDebug)
+	slow := s.slowThreshold > 0 && dur > s.slowThreshold && s.logger.Enabled(ctx, slog.LevelWarn)
+	if !debug && !slow {
+		return err
+	}
+	attrs = append(attrs, slog.String("op", op), slog.Duration("duration", dur))
+	if err != nil {
+		attrs = append(attrs, slog.Any("error", err))
+	}
+	if debug {
+		s.logger.LogAttrs(ctx, slog.LevelDebug, "parcel store", attrs...)
+	}
+	if slow {
+		attrs = append(attrs, slog.Duration("threshold", s.slowThreshold))
+		s.logger.LogAttrs(ctx, slog.LevelWarn, "slow parcel store operation", attrs...)
+	}
+	return err
+}
+
+// truncate обрезает text до maxLoggedText символов, чтобы адреса
+// не попадали в журнал целиком
+func truncate(text string) string {
+	if utf8.RuneCountInString(text) <= maxLoggedText {
+		return text
+	}
+	return string([]rune(text)[:maxLoggedText]) + "…"
+}
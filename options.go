@@ -0,0 +1,202 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Option настраивает ParcelStore при создании
+type Option func(*ParcelStore)
+
+// WithRetry включает повтор записывающих операций при временных ошибках
+// («database is locked» и т.п.): до attempts повторов с экспоненциально
+// растущей паузой, начиная с baseDelay. По умолчанию повторов нет.
+func WithRetry(attempts int, baseDelay time.Duration) Option {
+	return func(s *ParcelStore) {
+		s.retry = retryPolicy{attempts: attempts, baseDelay: baseDelay}
+	}
+}
+
+// WithTableName задаёт имя таблицы посылок вместо parcel, например чтобы держать
+// посылки разных арендаторов в одной базе. Имя нельзя передать параметром
+// запроса, поэтому оно подставляется в текст запросов в кавычках и должно быть
+// корректным идентификатором SQL (латинские буквы, цифры и _), иначе
+// NewParcelStore паникует. Рядом создаётся таблица истории <имя>_history.
+func WithTableName(name string) Option {
+	return func(s *ParcelStore) {
+		s.table = name
+	}
+}
+
+// WithClock задаёт источник текущего времени для отметок времени,
+// которые ставит хранилище. По умолчанию — time.Now.
+func WithClock(clock func() time.Time) Option {
+	return func(s *ParcelStore) {
+		s.clock = clock
+	}
+}
+
+// WithLogger задаёт журнал хранилища. На уровне Debug пишется каждая операция
+// с номером посылки или клиентом, длительностью и ошибкой; адреса обрезаются.
+// На уровне Warn пишутся повторы операций и медленные операции (см.
+// WithSlowQueryThreshold). По умолчанию журнал не ведётся.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *ParcelStore) {
+		s.logger = logger
+	}
+}
+
+// WithMetrics задаёт сборщик метрик, которому сообщается о каждой операции
+// хранилища. По умолчанию метрики не собираются.
+func WithMetrics(m MetricsCollector) Option {
+	return func(s *ParcelStore) {
+		if m == nil {
+			m = noopMetrics{}
+		}
+		s.metrics = m
+	}
+}
+
+// StatusChangeFunc вызывается после успешной смены статуса посылки
+// с предыдущим и новым статусом
+type StatusChangeFunc func(number int, old, new ParcelStatus)
+
+// WithOnStatusChange задаёт обработчик, который вызывается после фиксации каждой
+// смены статуса (SetStatus, Ship, SetStatusMany, ExpireStale и др.). При ошибке
+// обработчик не вызывается. Обработчик выполняется синхронно в горутине
+// вызывающего, поэтому долгую работу лучше выносить из него.
+func WithOnStatusChange(fn StatusChangeFunc) Option {
+	return func(s *ParcelStore) {
+		s.onStatusChange = fn
+	}
+}
+
+// BatchTransitionFunc вызывается после успешного TransitionBatch с его итогом
+type BatchTransitionFunc func(res TransitionResult)
+
+// WithOnBatchTransition задаёт обработчик, который вызывается один раз после
+// фиксации TransitionBatch с итогом пачки — в отличие от WithOnStatusChange,
+// вызываемого для каждой посылки. При ошибке обработчик не вызывается.
+// Выполняется синхронно в горутине вызывающего.
+func WithOnBatchTransition(fn BatchTransitionFunc) Option {
+	return func(s *ParcelStore) {
+		s.onBatch = fn
+	}
+}
+
+// WithOwnedDB передаёт хранилищу владение базой: Close закроет и *sql.DB.
+// Без этой опции база принадлежит вызывающему, и закрывать её нужно ему.
+func WithOwnedDB() Option {
+	return func(s *ParcelStore) {
+		s.ownsDB = true
+	}
+}
+
+// WithReadOnly запрещает хранилищу изменять базу, например при работе с репликой.
+// Все изменяющие методы, а также Migrate и Vacuum, возвращают ErrReadOnly,
+// не обращаясь к базе; методы чтения работают как обычно.
+func WithReadOnly() Option {
+	return func(s *ParcelStore) {
+		s.readOnly = true
+	}
+}
+
+// WithQueryTimeout ограничивает время выполнения каждого метода хранилища:
+// контекст метода получает срок d, и по его истечении метод возвращает ошибку,
+// оборачивающую context.DeadlineExceeded. Срок из ctx вызывающего, если он
+// короче, тоже действует. Для Iterate в срок входит и время работы fn.
+// При d == 0 (по умолчанию) ограничения нет.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(s *ParcelStore) {
+		s.queryTimeout = d
+	}
+}
+
+// WithSlowQueryThreshold включает предупреждения о медленных операциях:
+// операция, выполнявшаяся дольше d, пишется в журнал WithLogger на уровне
+// Warn с именем и длительностью, даже если уровень Debug выключен. Как и
+// в WithQueryTimeout, для Iterate учитывается время работы fn. При d == 0
+// (по умолчанию) предупреждений нет.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(s *ParcelStore) {
+		s.slowThreshold = d
+	}
+}
+
+// WithMaxAddressLength ограничивает длину адреса n символами (не байтами):
+// Add, SetAddress и остальные методы, задающие адрес, отклоняют более длинный
+// адрес с ErrAddressTooLong, не обращаясь к базе. Длина считается после
+// нормализации адреса. По умолчанию ограничение 512 символов, n <= 0 его снимает.
+func WithMaxAddressLength(n int) Option {
+	return func(s *ParcelStore) {
+		s.maxAddressLen = n
+	}
+}
+
+// WithPlaceholderAddresses задаёт адреса-заглушки (например, "test"), которые
+// FindIncompleteAddresses считает незаполненными наравне с пустым адресом.
+// Адреса сравниваются после нормализации и без учёта регистра; в SQLite
+// регистр не учитывается только для латиницы.
+func WithPlaceholderAddresses(addresses ...string) Option {
+	return func(s *ParcelStore) {
+		s.placeholders = make([]string, 0, len(addresses))
+		for _, a := range addresses {
+			s.placeholders = append(s.placeholders, strings.ToLower(NormalizeAddress(a)))
+		}
+	}
+}
+
+// WithAutoMigrate выполняет Migrate при создании хранилища, так что отдельный
+// вызов не нужен. Опция не включена по умолчанию, чтобы не трогать схему,
+// которой управляют снаружи (например, отдельными миграциями). Ошибку схемы
+// возвращает NewParcelStoreChecked; NewParcelStore при ней паникует.
+func WithAutoMigrate() Option {
+	return func(s *ParcelStore) {
+		s.autoMigrate = true
+	}
+}
+
+// WithMaxDeliveryAttempts задаёт число неудачных попыток доставки, после
+// которого RecordDeliveryAttempt переводит посылку в статус returned.
+// По умолчанию 3; при n <= 0 посылка не возвращается автоматически.
+func WithMaxDeliveryAttempts(n int) Option {
+	return func(s *ParcelStore) {
+		s.maxAttempts = n
+	}
+}
+
+// WithNumberAllocator задаёт, как выбираются номера новых посылок, например
+// ClientRangeAllocator для отдельного диапазона номеров у каждого клиента.
+// По умолчанию номера выдаёт база (AutoNumberAllocator). Явно заданный номер
+// посылки распределитель не меняет. Пока распределитель выбирает номер,
+// другие добавления ждут, поэтому при конкурентном использовании стоит
+// включить WithRetry.
+func WithNumberAllocator(a NumberAllocator) Option {
+	return func(s *ParcelStore) {
+		if a == nil {
+			a = AutoNumberAllocator{}
+		}
+		s.allocator = a
+	}
+}
+
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// isIdentifier сообщает, можно ли безопасно подставить name в запрос как имя таблицы
+func isIdentifier(name string) bool {
+	return identifierRe.MatchString(name)
+}
+
+// quoteIdent заключает идентификатор в двойные кавычки. Так имя таблицы может
+// совпадать с ключевым словом SQL, а PostgreSQL не приводит его к нижнему
+// регистру. name должен проходить isIdentifier, поэтому кавычек внутри нет.
+func quoteIdent(name string) string {
+	return `"` + name + `"`
+}
+
+// ident возвращает имя таблицы посылок, готовое к подстановке в запрос
+func (s ParcelStore) ident() string {
+	return quoteIdent(s.table)
+}
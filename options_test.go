@@ -0,0 +1,558 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestWithTableName проверяет работу хранилища с другим именем таблицы
+func TestWithTableName(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db, WithTableName("parcel_acme"))
+	require.NoError(t, store.Migrate())
+	parcel := getTestParcel()
+
+	// add & get
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, parcel.Address, got.Address)
+
+	// посылка лежит в своей таблице, а таблицы parcel нет вовсе
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM parcel_acme").Scan(&count))
+	require.Equal(t, 1, count)
+	_, err = NewParcelStore(db).Get(num)
+	require.Error(t, err)
+
+	// недопустимые имена таблицы
+	for _, name := range []string{"parcel; DROP TABLE parcel_acme", `parcel"`, "", "1parcel", "посылки"} {
+		require.Panics(t, func() { NewParcelStore(db, WithTableName(name)) }, name)
+	}
+}
+
+// TestTenantIsolation проверяет, что хранилища разных арендаторов в одной базе
+// не видят посылок друг друга
+func TestTenantIsolation(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	// имя таблицы может совпадать с ключевым словом SQL
+	acme := NewParcelStore(db, WithTableName("parcel_acme"))
+	order := NewParcelStore(db, WithTableName("order"))
+	require.NoError(t, acme.Migrate())
+	require.NoError(t, order.Migrate())
+
+	parcel := getTestParcel()
+
+	// add
+	acmeNum, err := acme.Add(parcel)
+	require.NoError(t, err)
+	orderNum, err := order.Add(parcel)
+	require.NoError(t, err)
+	// номера у каждого арендатора свои
+	require.Equal(t, acmeNum, orderNum)
+
+	// update
+	require.NoError(t, acme.SetAddress(acmeNum, "acme address"))
+	require.NoError(t, order.SetStatus(orderNum, ParcelStatusSent))
+
+	// check
+	got, err := acme.Get(acmeNum)
+	require.NoError(t, err)
+	require.Equal(t, "acme address", got.Address)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+
+	got, err = order.Get(orderNum)
+	require.NoError(t, err)
+	require.Equal(t, parcel.Address, got.Address)
+	require.Equal(t, ParcelStatusSent, got.Status)
+
+	history, err := acme.History(acmeNum)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, HistoryFieldAddress, history[0].Field)
+
+	// delete
+	require.NoError(t, acme.Delete(acmeNum))
+	_, err = acme.Get(acmeNum)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	parcels, err := order.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+}
+
+// TestWithClock проверяет, что отметки времени ставятся по заданным часам
+func TestWithClock(t *testing.T) {
+	// prepare
+	fixed := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return fixed }))
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// set status
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "2030-01-02T03:04:05Z", got.UpdatedAt)
+}
+
+// TestWithClockCreatedAt проверяет, что время создания посылки без CreatedAt
+// берётся по заданным часам
+func TestWithClockCreatedAt(t *testing.T) {
+	// prepare
+	fixed := time.Date(2030, 1, 2, 6, 4, 5, 0, time.FixedZone("MSK", 3*60*60))
+	store := newTestStore(t, WithClock(func() time.Time { return fixed }))
+
+	parcel := getTestParcel()
+	parcel.CreatedAt = ""
+
+	// add
+	got, err := store.AddAndGet(parcel)
+	require.NoError(t, err)
+
+	// check
+	require.Equal(t, "2030-01-02T03:04:05Z", got.CreatedAt)
+	require.Equal(t, "2030-01-02T03:04:05Z", got.UpdatedAt)
+}
+
+// recordHandler — slog.Handler, сохраняющий все записи журнала
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+// find возвращает атрибуты первой записи уровня level с атрибутом op == op
+func (h *recordHandler) find(level slog.Level, op string) (map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		if r.Level == level && attrs["op"].String() == op {
+			return attrs, true
+		}
+	}
+	return nil, false
+}
+
+// TestWithLogger проверяет, что операции хранилища пишутся в журнал
+func TestWithLogger(t *testing.T) {
+	// prepare
+	h := &recordHandler{}
+	store := newTestStore(t, WithLogger(slog.New(h)))
+
+	parcel := getTestParcel()
+	parcel.Address = "Псков, д. Пушкина, ул. Колотушкина, д. 5"
+
+	// add
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	attrs, ok := h.find(slog.LevelDebug, "Add")
+	require.True(t, ok)
+	require.Equal(t, int64(num), attrs["number"].Int64())
+	require.Equal(t, int64(parcel.Client), attrs["client"].Int64())
+	require.Contains(t, attrs, "duration")
+	require.NotContains(t, attrs, "error")
+
+	// ошибка попадает в журнал, адрес обрезается
+	err = store.SetAddress(-1, parcel.Address)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	attrs, ok = h.find(slog.LevelDebug, "SetAddress")
+	require.True(t, ok)
+	require.ErrorIs(t, attrs["error"].Any().(error), ErrParcelNotFound)
+	require.Equal(t, "Псков, д. Пушкин…", attrs["address"].String())
+}
+
+// TestWithLoggerRetry проверяет, что повторы операций пишутся в журнал
+func TestWithLoggerRetry(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	store := NewParcelStore(db, WithRetry(1, time.Millisecond),
+		WithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+	require.NoError(t, store.Migrate())
+
+	unlock := lockDB(t, path)
+	_, err = store.Add(getTestParcel())
+	require.Error(t, err)
+	require.NoError(t, unlock())
+
+	require.Contains(t, buf.String(), "retrying after transient error")
+}
+
+// TestWithSlowQueryThreshold проверяет, что медленная операция пишется
+// в журнал на уровне Warn, а быстрая — нет
+func TestWithSlowQueryThreshold(t *testing.T) {
+	// prepare
+	h := &recordHandler{}
+	store := newTestStore(t, WithLogger(slog.New(h)), WithSlowQueryThreshold(50*time.Millisecond))
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.Get(num)
+	require.NoError(t, err)
+
+	// медленная операция: Iterate учитывает время работы fn
+	err = store.Iterate(context.Background(), func(Parcel) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// check
+	attrs, ok := h.find(slog.LevelWarn, "Iterate")
+	require.True(t, ok)
+	require.GreaterOrEqual(t, attrs["duration"].Duration(), 100*time.Millisecond)
+	require.Equal(t, 50*time.Millisecond, attrs["threshold"].Duration())
+
+	_, ok = h.find(slog.LevelWarn, "Get")
+	require.False(t, ok)
+	_, ok = h.find(slog.LevelDebug, "Get")
+	require.True(t, ok)
+}
+
+// TestWithOnStatusChange проверяет вызов обработчика смены статуса
+func TestWithOnStatusChange(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	type change struct {
+		number   int
+		old, new ParcelStatus
+	}
+	var changes []change
+	store := NewParcelStore(db, WithOnStatusChange(func(number int, old, new ParcelStatus) {
+		changes = append(changes, change{number, old, new})
+	}))
+	require.NoError(t, store.Migrate())
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// set status
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	require.NoError(t, store.SetStatusIfVersion(num, ParcelStatusDelivered, 2))
+
+	// check
+	require.Equal(t, []change{
+		{num, ParcelStatusRegistered, ParcelStatusSent},
+		{num, ParcelStatusSent, ParcelStatusDelivered},
+	}, changes)
+
+	// неудачная смена статуса обработчик не вызывает
+	changes = nil
+	require.ErrorIs(t, store.SetStatus(num, ParcelStatusReturned), ErrInvalidStatusTransition)
+	require.ErrorIs(t, store.SetStatus(-1, ParcelStatusSent), ErrParcelNotFound)
+	require.Empty(t, changes)
+
+	// SetStatusAndAddress тоже сообщает о смене статуса
+	num, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatusAndAddress(num, ParcelStatusSent, "new address"))
+	require.Equal(t, []change{{num, ParcelStatusRegistered, ParcelStatusSent}}, changes)
+}
+
+// observation — одно обращение к сборщику метрик
+type observation struct {
+	name string
+	err  error
+}
+
+// fakeMetrics запоминает все обращения к сборщику метрик
+type fakeMetrics struct {
+	mu           sync.Mutex
+	observations []observation
+}
+
+func (m *fakeMetrics) ObserveOp(name string, dur time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observations = append(m.observations, observation{name, err})
+}
+
+// TestWithMetrics проверяет, что операции хранилища передаются сборщику метрик
+func TestWithMetrics(t *testing.T) {
+	// prepare
+	metrics := &fakeMetrics{}
+	store := newTestStore(t, WithMetrics(metrics))
+
+	// add & get
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.Get(num)
+	require.NoError(t, err)
+	_, err = store.Get(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// check
+	require.Len(t, metrics.observations, 4)
+	require.Equal(t, observation{"Migrate", nil}, metrics.observations[0])
+	require.Equal(t, observation{"Add", nil}, metrics.observations[1])
+	require.Equal(t, observation{"Get", nil}, metrics.observations[2])
+	require.Equal(t, "Get", metrics.observations[3].name)
+	require.ErrorIs(t, metrics.observations[3].err, ErrParcelNotFound)
+}
+
+// TestOpCounter проверяет встроенный счётчик операций
+func TestOpCounter(t *testing.T) {
+	// prepare
+	counter := NewOpCounter()
+	store := newTestStore(t, WithMetrics(counter))
+
+	// add & get
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.Get(num)
+	require.NoError(t, err)
+	_, err = store.Get(-1)
+	require.Error(t, err)
+
+	// check
+	require.Equal(t, 1, counter.Calls("Add"))
+	require.Zero(t, counter.Errors("Add"))
+	require.Equal(t, 2, counter.Calls("Get"))
+	require.Equal(t, 1, counter.Errors("Get"))
+	require.Zero(t, counter.Calls("Delete"))
+}
+
+// TestWithReadOnly проверяет, что хранилище только для чтения отказывает
+// в изменениях, не обращаясь к базе, а чтение работает
+func TestWithReadOnly(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+	parcel := getTestParcel()
+	parcel.Client = 1 + randRange.Intn(10_000_000)
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	ro := NewParcelStore(db, WithReadOnly())
+	ctx := context.Background()
+
+	// check
+	mutators := map[string]func() error{
+		"Migrate": ro.Migrate,
+		"Vacuum":  func() error { return ro.Vacuum(ctx) },
+		"Add": func() error {
+			_, err := ro.Add(parcel)
+			return err
+		},
+		"BatchAdd": func() error {
+			_, err := ro.BatchAdd([]Parcel{parcel})
+			return err
+		},
+		"BatchAddLenient": func() error {
+			_, _, err := ro.BatchAddLenient([]Parcel{parcel})
+			return err
+		},
+		"AddAndGet": func() error {
+			_, err := ro.AddAndGet(parcel)
+			return err
+		},
+		"Duplicate": func() error {
+			_, err := ro.Duplicate(num)
+			return err
+		},
+		"ImportCSV": func() error {
+			_, err := ro.ImportCSV(strings.NewReader("number,client,status,address,created_at\n"))
+			return err
+		},
+		"SetStatus":           func() error { return ro.SetStatus(num, ParcelStatusSent) },
+		"SetStatusIfVersion":  func() error { return ro.SetStatusIfVersion(num, ParcelStatusSent, 1) },
+		"SetStatusIf":         func() error { return ro.SetStatusIf(num, ParcelStatusRegistered, ParcelStatusSent) },
+		"ReRegister":          func() error { return ro.ReRegister(num) },
+		"Ship":                func() error { return ro.Ship(num) },
+		"Deliver":             func() error { return ro.Deliver(num) },
+		"SetStatusAndAddress": func() error { return ro.SetStatusAndAddress(num, ParcelStatusSent, "new") },
+		"SetAddress":          func() error { return ro.SetAddress(num, "new") },
+		"SetAddressIfVersion": func() error { return ro.SetAddressIfVersion(num, "new", 1) },
+		"SetClient":           func() error { return ro.SetClient(num, parcel.Client+1) },
+		"SetDeliveryWindow":   func() error { return ro.SetDeliveryWindow(num, nil, nil) },
+		"Delete":              func() error { return ro.Delete(num) },
+		"SoftDelete":          func() error { return ro.SoftDelete(num) },
+		"TruncateAll":         func() error { return ro.TruncateAll() },
+		"SetStatusMany": func() error {
+			_, err := ro.SetStatusMany([]int{num}, ParcelStatusSent)
+			return err
+		},
+		"PurgeDeletedBefore": func() error {
+			_, err := ro.PurgeDeletedBefore(time.Now())
+			return err
+		},
+		"DeleteByClient": func() error {
+			_, err := ro.DeleteByClient(parcel.Client)
+			return err
+		},
+		"TransitionBatch": func() error {
+			_, err := ro.TransitionBatch([]int{num}, ParcelStatusSent)
+			return err
+		},
+		"ExpireStale": func() error {
+			_, err := ro.ExpireStale(time.Hour)
+			return err
+		},
+		"DeleteOlderThan": func() error {
+			_, err := ro.DeleteOlderThan(ctx, time.Now())
+			return err
+		},
+		"SetMetadata": func() error { return ro.SetMetadata(num, map[string]string{"k": "v"}) },
+		"RecordDeliveryAttempt": func() error {
+			_, _, err := ro.RecordDeliveryAttempt(num)
+			return err
+		},
+	}
+	for name, mutate := range mutators {
+		require.ErrorIs(t, mutate(), ErrReadOnly, name)
+	}
+
+	got, err := ro.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	require.Equal(t, 1, got.Version)
+
+	byClient, err := ro.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Len(t, byClient, 1)
+}
+
+// TestWithQueryTimeout проверяет, что операция, ждущая снятия блокировки,
+// прерывается по истечении WithQueryTimeout
+func TestWithQueryTimeout(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db, WithRetry(1000, 10*time.Millisecond), WithQueryTimeout(50*time.Millisecond))
+	require.NoError(t, store.Migrate())
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	unlock := lockDB(t, path)
+	defer func() { require.NoError(t, unlock()) }()
+
+	// check
+	// без ограничения операции ждали бы блокировку до 1000 повторов
+	start := time.Now()
+	_, err = store.Add(getTestParcel())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	err = store.SetStatus(num, ParcelStatusSent)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+// TestWithMaxAddressLength проверяет ограничение длины адреса в символах
+func TestWithMaxAddressLength(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db, WithMaxAddressLength(10))
+	require.NoError(t, store.Migrate())
+
+	// 10 символов кириллицы — 20 байт, но в ограничение укладываются
+	atLimit := strings.Repeat("ж", 10)
+	overLimit := strings.Repeat("ж", 11)
+
+	// check
+	parcel := getTestParcel()
+	parcel.Address = atLimit
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	parcel.Address = overLimit
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrAddressTooLong)
+	_, err = store.BatchAdd([]Parcel{parcel})
+	require.ErrorIs(t, err, ErrAddressTooLong)
+
+	require.ErrorIs(t, store.SetAddress(num, overLimit), ErrAddressTooLong)
+	require.ErrorIs(t, store.SetStatusAndAddress(num, ParcelStatusSent, overLimit), ErrAddressTooLong)
+	require.NoError(t, store.SetAddress(num, strings.Repeat("ё", 10)))
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("ё", 10), got.Address)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+
+	// по умолчанию ограничение — размер колонки
+	parcel.Address = strings.Repeat("a", defaultMaxAddressLength+1)
+	_, err = NewParcelStore(db).Add(parcel)
+	require.ErrorIs(t, err, ErrAddressTooLong)
+	_, err = NewParcelStore(db, WithMaxAddressLength(0)).Add(parcel)
+	require.NoError(t, err)
+}
+
+// TestWithAutoMigrate проверяет, что хранилище с WithAutoMigrate готово к работе
+// сразу после создания
+func TestWithAutoMigrate(t *testing.T) {
+	// prepare
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	// у каждого подключения к :memory: своя база, поэтому подключение одно
+	db.SetMaxOpenConns(1)
+
+	store, err := NewParcelStoreChecked(db, WithAutoMigrate())
+	require.NoError(t, err)
+
+	// add
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// get
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "test", got.Address)
+
+	// set, delete
+	require.NoError(t, store.SetAddress(num, "new test address"))
+	require.NoError(t, store.Delete(num))
+	_, err = store.Get(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// ошибка схемы возвращается из конструктора
+	_, err = NewParcelStoreChecked(db, WithAutoMigrate(), WithReadOnly())
+	require.ErrorIs(t, err, ErrReadOnly)
+}
@@ -1,96 +1,2754 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	// ErrParcelNotFound возвращается, если посылки с указанным номером нет
+	ErrParcelNotFound = errors.New("parcel not found")
+	// ErrInvalidStatusTransition возвращается при попытке недопустимой смены статуса
+	ErrInvalidStatusTransition = errors.New("invalid status transition")
+	// ErrDeleteNotAllowed возвращается при попытке удалить посылку не в статусе registered
+	ErrDeleteNotAllowed = errors.New("delete not allowed")
+	// ErrAddressChangeNotAllowed возвращается при попытке сменить адрес посылки не в статусе registered
+	ErrAddressChangeNotAllowed = errors.New("address change not allowed")
+	// ErrInvalidPagination возвращается при некорректных limit или offset
+	ErrInvalidPagination = errors.New("invalid pagination")
+	// ErrEmptyPattern возвращается при поиске по пустой строке
+	ErrEmptyPattern = errors.New("empty search pattern")
+	// ErrUnknownStatus возвращается ParseStatus для строки, не являющейся статусом посылки
+	ErrUnknownStatus = errors.New("unknown parcel status")
+	// ErrInvalidParcel возвращается при добавлении посылки с некорректными полями
+	ErrInvalidParcel = errors.New("invalid parcel")
+	// ErrSchemaMissing возвращается Ping, если в базе нет таблицы посылок
+	ErrSchemaMissing = errors.New("schema missing")
+	// ErrSchemaMismatch возвращается VerifySchema, если колонки таблицы посылок
+	// не совпадают с теми, что создаёт Migrate
+	ErrSchemaMismatch = errors.New("schema mismatch")
+	// ErrVersionConflict возвращается, если посылка изменилась с момента её чтения.
+	// Нужно перечитать посылку и повторить изменение.
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrAddFailed возвращается, если после вставки не удалось получить номер посылки
+	ErrAddFailed = errors.New("add failed")
+	// ErrInvalidOrder возвращается при сортировке по колонке, которой нет в parcelOrderColumns
+	ErrInvalidOrder = errors.New("invalid order")
+	// ErrNilDB возвращается NewParcelStoreChecked, если вместо базы передан nil
+	ErrNilDB = errors.New("nil database")
+	// ErrDuplicateNumber возвращается при добавлении посылки с явно заданным номером,
+	// который уже занят
+	ErrDuplicateNumber = errors.New("duplicate parcel number")
+	// ErrReadOnly возвращается изменяющими операциями хранилища, созданного с WithReadOnly
+	ErrReadOnly = errors.New("store is read-only")
+	// ErrAddressTooLong возвращается, если адрес длиннее ограничения WithMaxAddressLength
+	ErrAddressTooLong = errors.New("address too long")
+	// ErrStatusMismatch возвращается SetStatusIf, если статус посылки не тот, что ожидался
+	ErrStatusMismatch = errors.New("status mismatch")
+	// ErrInvalidDeliveryWindow возвращается, если начало окна доставки не раньше конца
+	ErrInvalidDeliveryWindow = errors.New("invalid delivery window")
+	// ErrConstraintViolation возвращается, если запрос нарушил ограничение схемы
+	// (уникальность, NOT NULL, CHECK). Исходная ошибка драйвера остаётся в цепочке.
+	ErrConstraintViolation = errors.New("constraint violation")
+	// ErrBusy возвращается, если база занята другим соединением или транзакция
+	// конфликтует с параллельной; операцию можно повторить (см. WithRetry)
+	ErrBusy = errors.New("database busy")
+	// ErrConnection возвращается, если нет соединения с базой: она закрыта,
+	// не открывается или соединение оборвалось
+	ErrConnection = errors.New("database connection failed")
+)
+
+// statusTransitions задаёт допустимые переходы между статусами посылки:
+// для каждого статуса — список статусов, в которые из него можно перейти.
+var statusTransitions = map[ParcelStatus][]ParcelStatus{
+	ParcelStatusRegistered: {ParcelStatusSent, ParcelStatusExpired},
+	ParcelStatusSent:       {ParcelStatusDelivered, ParcelStatusReturned},
+}
+
+// canTransition сообщает, допустим ли переход из статуса from в статус to
+func canTransition(from, to ParcelStatus) bool {
+	if !to.Valid() {
+		return false
+	}
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceStatuses возвращает статусы, из которых можно перейти в статус to
+func sourceStatuses(to ParcelStatus) []ParcelStatus {
+	var res []ParcelStatus
+	for _, from := range parcelStatuses {
+		if canTransition(from, to) {
+			res = append(res, from)
+		}
+	}
+	return res
+}
+
+// Store описывает хранилище посылок. Код, работающий с посылками, должен зависеть
+// от этого интерфейса, а не от конкретной реализации ParcelStore.
+type Store interface {
+	Add(p Parcel) (int, error)
+	Get(number int) (Parcel, error)
+	GetByClient(client int) ([]Parcel, error)
+	SetStatus(number int, status ParcelStatus) error
+	SetAddress(number int, address string) error
+	Delete(number int) error
+}
+
+var _ Store = ParcelStore{}
+
+// ParcelStore — реализация Store поверх *sql.DB.
+//
+// ParcelStore безопасен для конкурентного использования из нескольких горутин:
+// *sql.DB сам разделяет пул соединений, кэш подготовленных запросов защищён
+// мьютексом, а остальные поля после NewParcelStore не меняются. Часы, логгер,
+// сборщик метрик и обработчик WithOnStatusChange тоже вызываются конкурентно.
+// Close нельзя вызывать одновременно с другими операциями. Хранилище, полученное
+// в WithTx, работает в одной транзакции и не должно использоваться после её завершения.
+type ParcelStore struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	dialect Dialect
+	retry   retryPolicy
+	table   string
+	clock   func() time.Time
+	logger  *slog.Logger
+	metrics MetricsCollector
+	stmts   *stmtCache
+
+	onStatusChange StatusChangeFunc
+	onBatch        BatchTransitionFunc
+	ownsDB         bool
+	readOnly       bool
+	queryTimeout   time.Duration
+	slowThreshold  time.Duration
+	maxAddressLen  int
+	placeholders   []string
+	autoMigrate    bool
+	maxAttempts    int
+	allocator      NumberAllocator
+}
+
+// NewParcelStore возвращает хранилище посылок, работающее с db.
+// Диалект SQL определяется по драйверу db (SQLite или PostgreSQL).
+// Возвращается конкретный тип, но в зависимостях лучше использовать Store.
+// Хранилище не владеет db: Close освобождает только подготовленные запросы,
+// а базу закрывает вызывающий, если не задана опция WithOwnedDB.
+// Для SQLite в памяти (":memory:") у каждого подключения пула своя база,
+// поэтому пул нужно ограничить одним подключением: db.SetMaxOpenConns(1).
+// При nil вместо db, некорректном имени таблицы или ошибке схемы при
+// WithAutoMigrate NewParcelStore паникует; чтобы получить ошибку, используйте
+// NewParcelStoreChecked.
+func NewParcelStore(db *sql.DB, opts ...Option) ParcelStore {
+	s, err := NewParcelStoreChecked(db, opts...)
+	if err != nil {
+		panic("parcel store: " + err.Error())
+	}
+	return s
+}
+
+// NewParcelStoreChecked работает как NewParcelStore, но вместо паники возвращает
+// ошибку: ErrNilDB, если db равна nil, ошибку о некорректном имени таблицы или,
+// при WithAutoMigrate, ошибку Migrate.
+func NewParcelStoreChecked(db *sql.DB, opts ...Option) (ParcelStore, error) {
+	if db == nil {
+		return ParcelStore{}, ErrNilDB
+	}
+
+	s := ParcelStore{
+		db:      db,
+		dialect: detectDialect(db),
+		table:   "parcel",
+		clock:   time.Now,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: noopMetrics{},
+		stmts:   newStmtCache(),
+
+		maxAddressLen: defaultMaxAddressLength,
+		maxAttempts:   defaultMaxDeliveryAttempts,
+		allocator:     AutoNumberAllocator{},
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	if !isIdentifier(s.table) {
+		return ParcelStore{}, fmt.Errorf("invalid table name %q", s.table)
+	}
+	if s.autoMigrate {
+		if err := s.Migrate(); err != nil {
+			return ParcelStore{}, fmt.Errorf("migrate: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// WithTx возвращает хранилище, все методы которого выполняются в транзакции tx,
+// открытой вызывающим на той же базе. Так операции хранилища можно объединить
+// с собственными запросами. Фиксирует или откатывает tx вызывающий; хранилище
+// только использует её. Методы, которым нужна своя транзакция (BatchAdd,
+// SetStatus и др.), выполняются внутри tx через SAVEPOINT, так что при ошибке
+// откатываются только их изменения. Повторы при временных ошибках внутри
+// чужой транзакции не выполняются. Возвращённое хранилище базой не владеет
+// даже при WithOwnedDB: его Close базу не закрывает.
+func (s ParcelStore) WithTx(tx *sql.Tx) ParcelStore {
+	s.tx = tx
+	s.ownsDB = false
+	return s
+}
+
+func (s ParcelStore) Add(p Parcel) (int, error) {
+	return s.AddContext(context.Background(), p)
+}
+
+func (s ParcelStore) AddContext(ctx context.Context, p Parcel) (id int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Add", start, err, slog.Int("number", id), slog.Int("client", p.Client)) }()
+
+	if _, auto := s.allocator.(AutoNumberAllocator); !auto && p.Number <= 0 {
+		// выбор номера и вставка должны быть в одной транзакции,
+		// иначе блокировка распределителя снимется до вставки
+		err = s.inTx(ctx, func(tx querier) error {
+			var err error
+			id, err = s.addParcel(ctx, tx, p)
+			return err
+		})
+		return id, err
+	}
+
+	err = s.withRetry(ctx, func() error {
+		var err error
+		id, err = s.addParcel(ctx, s.prepared(), p)
+		return err
+	})
+	return id, err
+}
+
+// BatchAdd добавляет несколько посылок в одной транзакции и возвращает их номера
+// в порядке следования посылок. При ошибке откатывается вся пачка.
+func (s ParcelStore) BatchAdd(parcels []Parcel) ([]int, error) {
+	return s.BatchAddContext(context.Background(), parcels)
+}
+
+func (s ParcelStore) BatchAddContext(ctx context.Context, parcels []Parcel) (_ []int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "BatchAdd", start, err, slog.Int("count", len(parcels))) }()
+
+	numbers := make([]int, 0, len(parcels))
+	err = s.inTx(ctx, func(tx querier) error {
+		for _, p := range parcels {
+			id, err := s.addParcel(ctx, tx, p)
+			if err != nil {
+				return err
+			}
+			numbers = append(numbers, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return numbers, nil
+}
+
+// BatchError — отказ BatchAddLenient добавить одну посылку
+type BatchError struct {
+	// Index — индекс посылки во входном срезе
+	Index int
+	// Err — причина: ErrInvalidParcel, ErrAddressTooLong или ErrDuplicateNumber
+	Err error
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("parcel at index %d: %v", e.Index, e.Err)
+}
+
+func (e BatchError) Unwrap() error {
+	return e.Err
+}
+
+// BatchAddLenient, в отличие от BatchAdd, не отменяет пачку из-за отдельных
+// посылок: некорректные посылки и посылки с уже занятым номером попадают
+// в failures, а остальные добавляются и фиксируются в одной транзакции.
+// numbers — номера добавленных посылок в порядке следования. Ошибка err
+// возвращается, только если не удалась сама транзакция, и тогда не
+// добавляется ни одна посылка.
+func (s ParcelStore) BatchAddLenient(parcels []Parcel) (numbers []int, failures []BatchError, err error) {
+	return s.BatchAddLenientContext(context.Background(), parcels)
+}
+
+func (s ParcelStore) BatchAddLenientContext(ctx context.Context, parcels []Parcel) (numbers []int, failures []BatchError, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "BatchAddLenient", start, err,
+			slog.Int("count", len(parcels)), slog.Int("failed", len(failures)))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		// транзакция может повториться, поэтому итог собирается заново
+		numbers = make([]int, 0, len(parcels))
+		failures = nil
+		for i, p := range parcels {
+			id, err := s.addParcelSavepoint(ctx, tx, p)
+			switch {
+			case err == nil:
+				numbers = append(numbers, id)
+			case errors.Is(err, ErrInvalidParcel), errors.Is(err, ErrAddressTooLong),
+				errors.Is(err, ErrDuplicateNumber):
+				failures = append(failures, BatchError{Index: i, Err: err})
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return numbers, failures, nil
+}
+
+// addParcelSavepoint добавляет посылку под точкой сохранения, чтобы ошибка
+// вставки не прерывала транзакцию: в PostgreSQL после ошибки запроса
+// остальные запросы транзакции отклоняются до отката к точке сохранения
+func (s ParcelStore) addParcelSavepoint(ctx context.Context, tx querier, p Parcel) (int, error) {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT parcel_add"); err != nil {
+		return 0, err
+	}
+	id, err := s.addParcel(ctx, tx, p)
+	if err != nil {
+		if _, rbErr := tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT parcel_add"); rbErr != nil {
+			return 0, errors.Join(err, rbErr)
+		}
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT parcel_add")
+	return id, err
+}
+
+// AddAndGet добавляет посылку и возвращает её в том виде, в котором она сохранена,
+// с заполненным номером. Добавление и чтение выполняются в одной транзакции.
+func (s ParcelStore) AddAndGet(p Parcel) (Parcel, error) {
+	return s.AddAndGetContext(context.Background(), p)
+}
+
+func (s ParcelStore) AddAndGetContext(ctx context.Context, p Parcel) (res Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "AddAndGet", start, err, slog.Int("number", res.Number), slog.Int("client", p.Client))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		id, err := s.addParcel(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		res, err = s.getParcel(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return Parcel{}, err
+	}
+	return res, nil
+}
+
+// Duplicate создаёт копию посылки для повторной отправки: с тем же клиентом
+// и адресом, но с новым номером, статусом registered и временем создания
+// по часам хранилища. Возвращает номер копии или ErrParcelNotFound.
+func (s ParcelStore) Duplicate(number int) (int, error) {
+	return s.DuplicateContext(context.Background(), number)
+}
+
+func (s ParcelStore) DuplicateContext(ctx context.Context, number int) (id int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "Duplicate", start, err, slog.Int("number", number), slog.Int("copy", id))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		src, err := s.getParcel(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		id, err = s.addParcel(ctx, tx, Parcel{
+			Client:  src.Client,
+			Status:  ParcelStatusRegistered,
+			Address: src.Address,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (s ParcelStore) Get(number int) (Parcel, error) {
+	return s.GetContext(context.Background(), number)
+}
+
+func (s ParcelStore) GetContext(ctx context.Context, number int) (_ Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Get", start, err, slog.Int("number", number)) }()
+
+	return s.getParcel(ctx, s.prepared(), number)
+}
+
+// Exists сообщает, есть ли посылка с номером number, не читая её саму.
+// Для отсутствующей посылки возвращается (false, nil), а не ErrParcelNotFound.
+func (s ParcelStore) Exists(number int) (bool, error) {
+	return s.ExistsContext(context.Background(), number)
+}
+
+func (s ParcelStore) ExistsContext(ctx context.Context, number int) (exists bool, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Exists", start, err, slog.Int("number", number)) }()
+
+	return s.exists(ctx, s.conn(), number)
+}
+
+// GetStatus возвращает только статус посылки, не читая остальные поля, —
+// для частых проверок статуса. Для отсутствующей посылки возвращается
+// ErrParcelNotFound.
+func (s ParcelStore) GetStatus(number int) (ParcelStatus, error) {
+	return s.GetStatusContext(context.Background(), number)
+}
+
+func (s ParcelStore) GetStatusContext(ctx context.Context, number int) (status ParcelStatus, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetStatus", start, err, slog.Int("number", number)) }()
+
+	row := s.conn().QueryRowContext(ctx, "SELECT status FROM "+s.ident()+" WHERE number = :number AND deleted_at = ''",
+		sql.Named("number", number))
+	err = row.Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+func (s ParcelStore) exists(ctx context.Context, q querier, number int) (bool, error) {
+	var exists bool
+	row := q.QueryRowContext(ctx,
+		"SELECT EXISTS(SELECT 1 FROM "+s.ident()+" WHERE number = :number AND deleted_at = '')",
+		sql.Named("number", number))
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// GetMany возвращает посылки с указанными номерами одним запросом. Номера,
+// для которых посылок нет, в результате просто отсутствуют.
+func (s ParcelStore) GetMany(numbers []int) (map[int]Parcel, error) {
+	return s.GetManyContext(context.Background(), numbers)
+}
+
+func (s ParcelStore) GetManyContext(ctx context.Context, numbers []int) (_ map[int]Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetMany", start, err, slog.Int("count", len(numbers))) }()
+
+	return s.getMany(ctx, numbers)
+}
+
+// GetManyOrdered, как и GetMany, возвращает посылки одним запросом, но в виде
+// среза, выровненного по numbers: i-й элемент — посылка с номером numbers[i]
+// или nil, если её нет. Повторяющиеся номера дают отдельные копии посылки.
+func (s ParcelStore) GetManyOrdered(numbers []int) ([]*Parcel, error) {
+	return s.GetManyOrderedContext(context.Background(), numbers)
+}
+
+func (s ParcelStore) GetManyOrderedContext(ctx context.Context, numbers []int) (_ []*Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetManyOrdered", start, err, slog.Int("count", len(numbers))) }()
+
+	found, err := s.getMany(ctx, numbers)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Parcel, len(numbers))
+	for i, num := range numbers {
+		if p, ok := found[num]; ok {
+			res[i] = &p
+		}
+	}
+	return res, nil
+}
+
+// getMany выбирает посылки с номерами numbers одним запросом
+func (s ParcelStore) getMany(ctx context.Context, numbers []int) (map[int]Parcel, error) {
+	res := make(map[int]Parcel, len(numbers))
+	if len(numbers) == 0 {
+		return res, nil
+	}
+
+	in, args := inClause("number", numbers)
+	parcels, err := queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE number IN ("+in+") AND deleted_at = ''", args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parcels {
+		res[p.Number] = p
+	}
+	return res, nil
+}
+
+// GetByClient возвращает посылки клиента, упорядоченные по номеру
+func (s ParcelStore) GetByClient(client int) ([]Parcel, error) {
+	return s.GetByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) GetByClientContext(ctx context.Context, client int) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetByClient", start, err, slog.Int("client", client)) }()
+
+	return queryParcels(ctx, s.conn(), s.getByClientQuery(), sql.Named("client", client))
+}
+
+// getByClientQuery — запрос GetByClient; вынесен для ExplainGetByClient
+func (s ParcelStore) getByClientQuery() string {
+	return "SELECT " + parcelColumns + " FROM " + s.ident() + " WHERE client = :client AND deleted_at = '' ORDER BY number"
+}
+
+// parcelOrderColumns — колонки, по которым можно сортировать в GetByClientSorted.
+// Имя колонки подставляется в текст запроса, поэтому допускаются только они.
+var parcelOrderColumns = map[string]bool{
+	"number":     true,
+	"status":     true,
+	"created_at": true,
+}
+
+// GetByClientSorted возвращает посылки клиента, упорядоченные по колонке orderBy
+// (number, status или created_at) по возрастанию или, если desc, по убыванию.
+// Посылки с равными значениями упорядочиваются по номеру. Для других колонок
+// возвращается ErrInvalidOrder.
+func (s ParcelStore) GetByClientSorted(client int, orderBy string, desc bool) ([]Parcel, error) {
+	return s.GetByClientSortedContext(context.Background(), client, orderBy, desc)
+}
+
+func (s ParcelStore) GetByClientSortedContext(ctx context.Context, client int, orderBy string, desc bool) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "GetByClientSorted", start, err,
+			slog.Int("client", client), slog.String("order_by", orderBy), slog.Bool("desc", desc))
+	}()
+
+	if !parcelOrderColumns[orderBy] {
+		return nil, fmt.Errorf("%w: column %q", ErrInvalidOrder, orderBy)
+	}
+	order := orderBy
+	if desc {
+		order += " DESC"
+	}
+	if orderBy != "number" {
+		order += ", number"
+	}
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE client = :client AND deleted_at = '' ORDER BY "+order,
+		sql.Named("client", client))
+}
+
+// GetLatestByClient возвращает самую новую посылку клиента по времени создания,
+// а среди созданных одновременно — с наибольшим номером. Если посылок у клиента
+// нет, возвращается ErrParcelNotFound.
+func (s ParcelStore) GetLatestByClient(client int) (Parcel, error) {
+	return s.GetLatestByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) GetLatestByClientContext(ctx context.Context, client int) (_ Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetLatestByClient", start, err, slog.Int("client", client)) }()
+
+	row := s.conn().QueryRowContext(ctx,
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE client = :client AND deleted_at = '' ORDER BY created_at DESC, number DESC LIMIT 1",
+		sql.Named("client", client))
+	p, err := scanParcel(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Parcel{}, fmt.Errorf("client %d: %w", client, ErrParcelNotFound)
+	}
+	if err != nil {
+		return Parcel{}, err
+	}
+	return p, nil
+}
+
+// GetByClientAndStatus возвращает посылки клиента в статусе status,
+// упорядоченные по номеру
+func (s ParcelStore) GetByClientAndStatus(client int, status ParcelStatus) ([]Parcel, error) {
+	return s.GetByClientAndStatusContext(context.Background(), client, status)
+}
+
+func (s ParcelStore) GetByClientAndStatusContext(ctx context.Context, client int, status ParcelStatus) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "GetByClientAndStatus", start, err, slog.Int("client", client), slog.String("status", string(status)))
+	}()
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE client = :client AND status = :status AND deleted_at = '' ORDER BY number",
+		sql.Named("client", client),
+		sql.Named("status", status))
+}
+
+// GetAll возвращает все посылки, упорядоченные по номеру. Предназначен для
+// административных задач: посылок может быть много, поэтому для обычного
+// использования есть GetAllPaged.
+func (s ParcelStore) GetAll() ([]Parcel, error) {
+	return s.GetAllContext(context.Background())
+}
+
+func (s ParcelStore) GetAllContext(ctx context.Context) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetAll", start, err) }()
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number")
+}
+
+// AllGroupedByClient возвращает все посылки одним запросом, сгруппированные
+// по клиенту; в каждой группе посылки упорядочены по номеру. Для пустой таблицы
+// возвращается пустая карта.
+func (s ParcelStore) AllGroupedByClient() (map[int][]Parcel, error) {
+	return s.AllGroupedByClientContext(context.Background())
+}
+
+func (s ParcelStore) AllGroupedByClientContext(ctx context.Context) (_ map[int][]Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "AllGroupedByClient", start, err) }()
+
+	res := map[int][]Parcel{}
+	err = iterParcels(ctx, s.conn(), func(p Parcel) error {
+		res[p.Client] = append(res[p.Client], p)
+		return nil
+	}, "SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number")
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetAllPaged возвращает страницу всех посылок, упорядоченных по номеру.
+// Ограничения на limit и offset те же, что в GetByClientPaged.
+func (s ParcelStore) GetAllPaged(limit, offset int) ([]Parcel, error) {
+	return s.GetAllPagedContext(context.Background(), limit, offset)
+}
+
+func (s ParcelStore) GetAllPagedContext(ctx context.Context, limit, offset int) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "GetAllPaged", start, err, slog.Int("limit", limit), slog.Int("offset", offset))
+	}()
+
+	if limit <= 0 || offset < 0 {
+		return nil, fmt.Errorf("%w: limit %d, offset %d", ErrInvalidPagination, limit, offset)
+	}
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number LIMIT :limit OFFSET :offset",
+		sql.Named("limit", limit),
+		sql.Named("offset", offset))
+}
+
+// Iterate вызывает fn для каждой посылки в порядке номеров, читая строки по одной,
+// так что память не зависит от числа посылок. Если fn возвращает ошибку, обход
+// прекращается и Iterate возвращает эту ошибку. Пока идёт обход, подключение
+// к базе занято, поэтому fn не должна обращаться к хранилищу внутри WithTx.
+func (s ParcelStore) Iterate(ctx context.Context, fn func(Parcel) error) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Iterate", start, err) }()
+
+	return iterParcels(ctx, s.conn(), fn,
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY number")
+}
+
+// Stream отправляет все посылки в порядке номеров в канал посылок, читая их
+// из базы по одной, и закрывает его по окончании. Если чтение завершилось
+// ошибкой, она отправляется в канал ошибок; он закрывается после канала
+// посылок, поэтому ошибку нужно читать, когда канал посылок вычитан. При отмене
+// ctx чтение прекращается, подключение освобождается, а в канал ошибок
+// приходит ошибка ctx, даже если посылки больше не читают. Как и для Iterate,
+// пока идёт чтение, подключение к базе занято.
+func (s ParcelStore) Stream(ctx context.Context) (<-chan Parcel, <-chan error) {
+	parcels := make(chan Parcel)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		err := s.Iterate(ctx, func(p Parcel) error {
+			select {
+			case parcels <- p:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(parcels)
+		if err != nil {
+			errc <- err
+		}
+	}()
+	return parcels, errc
+}
+
+// GetByClientPaged возвращает страницу посылок клиента, упорядоченных по номеру.
+// limit должен быть положительным, offset — неотрицательным, иначе возвращается
+// ErrInvalidPagination.
+func (s ParcelStore) GetByClientPaged(client, limit, offset int) ([]Parcel, error) {
+	return s.GetByClientPagedContext(context.Background(), client, limit, offset)
+}
+
+func (s ParcelStore) GetByClientPagedContext(ctx context.Context, client, limit, offset int) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "GetByClientPaged", start, err,
+			slog.Int("client", client), slog.Int("limit", limit), slog.Int("offset", offset))
+	}()
+
+	if limit <= 0 || offset < 0 {
+		return nil, fmt.Errorf("%w: limit %d, offset %d", ErrInvalidPagination, limit, offset)
+	}
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE client = :client AND deleted_at = '' ORDER BY number LIMIT :limit OFFSET :offset",
+		sql.Named("client", client),
+		sql.Named("limit", limit),
+		sql.Named("offset", offset))
+}
+
+// Count возвращает общее количество посылок одним запросом; для пустой
+// таблицы — 0. Удалённые посылки не учитываются.
+func (s ParcelStore) Count() (int, error) {
+	return s.CountContext(context.Background())
+}
+
+func (s ParcelStore) CountContext(ctx context.Context) (count int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Count", start, err) }()
+
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.ident()+" WHERE deleted_at = ''")
+	if err = row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountByClient возвращает количество посылок клиента
+func (s ParcelStore) CountByClient(client int) (int, error) {
+	return s.CountByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) CountByClientContext(ctx context.Context, client int) (count int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "CountByClient", start, err, slog.Int("client", client)) }()
+
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.ident()+" WHERE client = :client AND deleted_at = ''",
+		sql.Named("client", client))
+	if err = row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// TotalWeightByClient возвращает суммарный вес посылок клиента в граммах;
+// для клиента без посылок — 0
+func (s ParcelStore) TotalWeightByClient(client int) (float64, error) {
+	return s.TotalWeightByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) TotalWeightByClientContext(ctx context.Context, client int) (total float64, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "TotalWeightByClient", start, err, slog.Int("client", client)) }()
+
+	row := s.conn().QueryRowContext(ctx,
+		"SELECT COALESCE(SUM(weight), 0) FROM "+s.ident()+" WHERE client = :client AND deleted_at = ''",
+		sql.Named("client", client))
+	if err = row.Scan(&total); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// DistinctClients возвращает по возрастанию номера клиентов, у которых есть
+// хотя бы одна посылка. Для пустой таблицы возвращается пустой срез.
+func (s ParcelStore) DistinctClients() ([]int, error) {
+	return s.DistinctClientsContext(context.Background())
+}
+
+func (s ParcelStore) DistinctClientsContext(ctx context.Context) (_ []int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "DistinctClients", start, err) }()
+
+	rows, err := s.conn().QueryContext(ctx,
+		"SELECT DISTINCT client FROM "+s.ident()+" WHERE deleted_at = '' ORDER BY client")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []int{}
+	for rows.Next() {
+		var client int
+		if err := rows.Scan(&client); err != nil {
+			return nil, err
+		}
+		res = append(res, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// FindIncompleteAddresses возвращает упорядоченные по номеру посылки, адрес
+// которых пуст, состоит из одних пробелов или совпадает с одной из заглушек,
+// заданных через WithPlaceholderAddresses. Если таких посылок нет,
+// возвращается пустой срез.
+func (s ParcelStore) FindIncompleteAddresses() ([]Parcel, error) {
+	return s.FindIncompleteAddressesContext(context.Background())
+}
+
+func (s ParcelStore) FindIncompleteAddressesContext(ctx context.Context) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "FindIncompleteAddresses", start, err) }()
+
+	where := "TRIM(address) = ''"
+	var args []any
+	if len(s.placeholders) > 0 {
+		var in string
+		in, args = inClause("placeholder", s.placeholders)
+		where += " OR LOWER(TRIM(address)) IN (" + in + ")"
+	}
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE deleted_at = '' AND ("+where+") ORDER BY number",
+		args...)
+}
+
+func (s ParcelStore) GetByStatus(status ParcelStatus) ([]Parcel, error) {
+	return s.GetByStatusContext(context.Background(), status)
+}
+
+func (s ParcelStore) GetByStatusContext(ctx context.Context, status ParcelStatus) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetByStatus", start, err, slog.String("status", string(status))) }()
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE status = :status AND deleted_at = '' ORDER BY number",
+		sql.Named("status", status))
+}
+
+// StatusCounts возвращает количество посылок в каждом статусе. В результате есть
+// все известные статусы, в том числе те, в которых посылок нет (с нулём).
+func (s ParcelStore) StatusCounts() (map[ParcelStatus]int, error) {
+	return s.StatusCountsContext(context.Background())
+}
+
+func (s ParcelStore) StatusCountsContext(ctx context.Context) (_ map[ParcelStatus]int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "StatusCounts", start, err) }()
+
+	counts, err := queryStatusCounts(ctx, s.conn(),
+		"SELECT status, COUNT(*) FROM "+s.ident()+" WHERE deleted_at = '' GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+	// статусы без посылок отсутствуют в результате запроса
+	for _, status := range parcelStatuses {
+		if _, ok := counts[status]; !ok {
+			counts[status] = 0
+		}
+	}
+	return counts, nil
+}
+
+// StatusCountsByClient возвращает количество посылок клиента в каждом статусе
+// одним запросом. В отличие от StatusCounts, в результате только статусы,
+// в которых у клиента есть посылки; для клиента без посылок карта пустая.
+func (s ParcelStore) StatusCountsByClient(client int) (map[ParcelStatus]int, error) {
+	return s.StatusCountsByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) StatusCountsByClientContext(ctx context.Context, client int) (_ map[ParcelStatus]int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "StatusCountsByClient", start, err, slog.Int("client", client)) }()
+
+	return queryStatusCounts(ctx, s.conn(), s.statusCountsByClientQuery(), sql.Named("client", client))
+}
+
+// statusCountsByClientQuery — запрос StatusCountsByClient; вынесен для
+// ExplainStatusCountsByClient
+func (s ParcelStore) statusCountsByClientQuery() string {
+	return "SELECT status, COUNT(*) FROM " + s.ident() + " WHERE client = :client AND deleted_at = '' GROUP BY status"
+}
+
+// ClientSummary — сводка по посылкам клиента
+type ClientSummary struct {
+	// Total — общее количество посылок клиента
+	Total int
+	// ByStatus — количество посылок в каждом статусе; статусы без посылок отсутствуют
+	ByStatus map[ParcelStatus]int
+	// LastCreatedAt — время создания самой новой посылки в формате CreatedAt
+	LastCreatedAt string
+}
+
+// ClientSummary возвращает сводку по посылкам клиента, собранную одним
+// запросом с группировкой по статусу. Для клиента без посылок возвращается
+// нулевое значение ClientSummary.
+func (s ParcelStore) ClientSummary(client int) (ClientSummary, error) {
+	return s.ClientSummaryContext(context.Background(), client)
+}
+
+func (s ParcelStore) ClientSummaryContext(ctx context.Context, client int) (_ ClientSummary, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ClientSummary", start, err, slog.Int("client", client)) }()
+
+	rows, err := s.conn().QueryContext(ctx,
+		"SELECT status, COUNT(*), MAX(created_at) FROM "+s.ident()+" WHERE client = :client AND deleted_at = '' GROUP BY status",
+		sql.Named("client", client))
+	if err != nil {
+		return ClientSummary{}, err
+	}
+	defer rows.Close()
+
+	var sum ClientSummary
+	for rows.Next() {
+		var (
+			status  ParcelStatus
+			count   int
+			created string
+		)
+		if err := rows.Scan(&status, &count, &created); err != nil {
+			return ClientSummary{}, err
+		}
+		if sum.ByStatus == nil {
+			sum.ByStatus = map[ParcelStatus]int{}
+		}
+		sum.ByStatus[status] = count
+		sum.Total += count
+		// время хранится в RFC3339 в UTC, поэтому строки сравниваются как время
+		if created > sum.LastCreatedAt {
+			sum.LastCreatedAt = created
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return ClientSummary{}, err
+	}
+	return sum, nil
+}
+
+// queryStatusCounts выполняет запрос, возвращающий пары (статус, количество),
+// и собирает их в карту
+func queryStatusCounts(ctx context.Context, q querier, query string, args ...any) (map[ParcelStatus]int, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[ParcelStatus]int, len(parcelStatuses))
+	for rows.Next() {
+		var (
+			status ParcelStatus
+			count  int
+		)
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// SearchByAddress возвращает посылки, в адресе которых встречается pattern,
+// упорядоченные по номеру. Символы % и _ в pattern ищутся буквально.
+// Поиск не зависит от регистра; в SQLite это работает только для латиницы.
+// Для пустого pattern возвращается ErrEmptyPattern.
+func (s ParcelStore) SearchByAddress(pattern string) ([]Parcel, error) {
+	return s.SearchByAddressContext(context.Background(), pattern)
+}
+
+func (s ParcelStore) SearchByAddressContext(ctx context.Context, pattern string) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "SearchByAddress", start, err, slog.String("pattern", truncate(pattern))) }()
+
+	if pattern == "" {
+		return nil, ErrEmptyPattern
+	}
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE LOWER(address) LIKE LOWER(:pattern) ESCAPE '\\' AND deleted_at = '' ORDER BY number",
+		sql.Named("pattern", "%"+escapeLike(pattern)+"%"))
+}
+
+// numberPrefixLimit — сколько посылок не больше возвращает GetByNumberPrefix
+const numberPrefixLimit = 100
+
+// GetByNumberPrefix возвращает посылки, номер которых в десятичной записи
+// начинается с цифр prefix, упорядоченные по номеру, но не больше
+// numberPrefixLimit. Ведущие нули в int теряются, а номера посылок с нуля
+// не начинаются, поэтому для prefix <= 0 возвращается пустой срез.
+func (s ParcelStore) GetByNumberPrefix(prefix int) ([]Parcel, error) {
+	return s.GetByNumberPrefixContext(context.Background(), prefix)
+}
+
+func (s ParcelStore) GetByNumberPrefixContext(ctx context.Context, prefix int) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "GetByNumberPrefix", start, err, slog.Int("prefix", prefix)) }()
+
+	if prefix <= 0 {
+		return []Parcel{}, nil
+	}
+
+	// в записи числа нет символов % и _, экранировать prefix не нужно
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE CAST(number AS TEXT) LIKE :pattern AND deleted_at = '' ORDER BY number LIMIT :limit",
+		sql.Named("pattern", strconv.Itoa(prefix)+"%"),
+		sql.Named("limit", numberPrefixLimit))
+}
+
+// GetByDateRange возвращает посылки, созданные в промежутке [from, to] включительно,
+// упорядоченные по времени создания. Время создания хранится строкой RFC3339 в UTC,
+// поэтому границы тоже приводятся к UTC, чтобы строковое сравнение было корректным.
+func (s ParcelStore) GetByDateRange(from, to time.Time) ([]Parcel, error) {
+	return s.GetByDateRangeContext(context.Background(), from, to)
+}
+
+func (s ParcelStore) GetByDateRangeContext(ctx context.Context, from, to time.Time) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "GetByDateRange", start, err, slog.Time("from", from), slog.Time("to", to))
+	}()
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE created_at >= :from AND created_at <= :to AND deleted_at = ''"+
+			" ORDER BY created_at, number",
+		sql.Named("from", formatTime(from)),
+		sql.Named("to", formatTime(to)))
+}
+
+// ChangedSince возвращает посылки, изменённые в момент t или позже,
+// упорядоченные по времени изменения, — для инкрементальной синхронизации:
+// следующий вызов делается с UpdatedAt последней полученной посылки. Время
+// хранится с точностью до секунды, поэтому граница включается: иначе
+// изменения, сделанные в ту же секунду, были бы потеряны. Посылки, уже
+// полученные с той же версией, вызывающий пропускает по паре (Number, Version).
+// Граница, как и в GetByDateRange, приводится к UTC. Посылки, помеченные
+// удалёнными, не возвращаются.
+func (s ParcelStore) ChangedSince(t time.Time) ([]Parcel, error) {
+	return s.ChangedSinceContext(context.Background(), t)
+}
+
+func (s ParcelStore) ChangedSinceContext(ctx context.Context, t time.Time) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ChangedSince", start, err, slog.Time("since", t)) }()
+
+	return queryParcels(ctx, s.conn(),
+		"SELECT "+parcelColumns+" FROM "+s.ident()+
+			" WHERE updated_at >= :since AND deleted_at = '' ORDER BY updated_at, number",
+		sql.Named("since", formatTime(t)))
+}
+
+// ParcelFilter — условия отбора посылок для Find. Незаданные (nil) поля
+// не ограничивают выборку.
+type ParcelFilter struct {
+	Client *int
+	Status *ParcelStatus
+	// CreatedAfter и CreatedBefore ограничивают время создания строго:
+	// посылка, созданная ровно в граничный момент, не попадает в выборку
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Limit ограничивает число посылок; 0 означает «без ограничения».
+	// Offset пропускает первые посылки выборки.
+	Limit  int
+	Offset int
+}
+
+// Find возвращает упорядоченные по номеру посылки, подходящие под все
+// заданные условия f. Условия подставляются в запрос параметрами. При
+// отрицательных Limit или Offset возвращается ErrInvalidPagination;
+// если ничего не найдено — пустой срез.
+func (s ParcelStore) Find(f ParcelFilter) ([]Parcel, error) {
+	return s.FindContext(context.Background(), f)
+}
+
+func (s ParcelStore) FindContext(ctx context.Context, f ParcelFilter) (_ []Parcel, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Find", start, err) }()
+
+	if f.Limit < 0 || f.Offset < 0 {
+		return nil, fmt.Errorf("%w: limit %d, offset %d", ErrInvalidPagination, f.Limit, f.Offset)
+	}
+
+	where := []string{"deleted_at = ''"}
+	var args []any
+	if f.Client != nil {
+		where = append(where, "client = :client")
+		args = append(args, sql.Named("client", *f.Client))
+	}
+	if f.Status != nil {
+		where = append(where, "status = :status")
+		args = append(args, sql.Named("status", *f.Status))
+	}
+	if f.CreatedAfter != nil {
+		where = append(where, "created_at > :created_after")
+		args = append(args, sql.Named("created_after", formatTime(*f.CreatedAfter)))
+	}
+	if f.CreatedBefore != nil {
+		where = append(where, "created_at < :created_before")
+		args = append(args, sql.Named("created_before", formatTime(*f.CreatedBefore)))
+	}
+
+	query := "SELECT " + parcelColumns + " FROM " + s.ident() + " WHERE " + strings.Join(where, " AND ") + " ORDER BY number"
+	switch {
+	case f.Limit > 0:
+		query += " LIMIT :limit"
+		args = append(args, sql.Named("limit", f.Limit))
+	case f.Offset > 0 && s.dialect == DialectSQLite:
+		// в SQLite OFFSET допустим только вместе с LIMIT; -1 — без ограничения
+		query += " LIMIT -1"
+	}
+	if f.Offset > 0 {
+		query += " OFFSET :offset"
+		args = append(args, sql.Named("offset", f.Offset))
+	}
+	return queryParcels(ctx, s.conn(), query, args...)
+}
+
+func (s ParcelStore) SetStatus(number int, status ParcelStatus) error {
+	return s.SetStatusContext(context.Background(), number, status)
+}
+
+// SetStatusContext меняет статус посылки. Переход проверяется по statusTransitions;
+// при недопустимом переходе возвращается ErrInvalidStatusTransition и посылка не меняется.
+func (s ParcelStore) SetStatusContext(ctx context.Context, number int, status ParcelStatus) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetStatus", start, err, slog.Int("number", number), slog.String("status", string(status)))
+	}()
+
+	var old ParcelStatus
+	err = s.inTx(ctx, func(tx querier) error {
+		var err error
+		old, err = s.setStatus(ctx, tx, number, status, anyVersion)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, old, status)
+	return nil
+}
+
+// SetStatusIfVersion меняет статус посылки, только если её версия равна version.
+// Если посылку успели изменить, возвращается ErrVersionConflict.
+func (s ParcelStore) SetStatusIfVersion(number int, status ParcelStatus, version int) error {
+	return s.SetStatusIfVersionContext(context.Background(), number, status, version)
+}
+
+func (s ParcelStore) SetStatusIfVersionContext(ctx context.Context, number int, status ParcelStatus, version int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetStatusIfVersion", start, err,
+			slog.Int("number", number), slog.String("status", string(status)), slog.Int("version", version))
+	}()
+
+	var old ParcelStatus
+	err = s.inTx(ctx, func(tx querier) error {
+		var err error
+		old, err = s.setStatus(ctx, tx, number, status, version)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, old, status)
+	return nil
+}
+
+// SetStatusIf меняет статус посылки с expected на next одним условным UPDATE,
+// без предварительного чтения. Если посылка есть, но её статус не expected,
+// возвращается ErrStatusMismatch, если посылки нет — ErrParcelNotFound.
+// Переход expected -> next проверяется по statusTransitions заранее; при
+// недопустимом переходе возвращается ErrInvalidStatusTransition.
+func (s ParcelStore) SetStatusIf(number int, expected, next ParcelStatus) error {
+	return s.SetStatusIfContext(context.Background(), number, expected, next)
+}
+
+func (s ParcelStore) SetStatusIfContext(ctx context.Context, number int, expected, next ParcelStatus) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetStatusIf", start, err, slog.Int("number", number),
+			slog.String("expected", string(expected)), slog.String("status", string(next)))
+	}()
+
+	if !canTransition(expected, next) {
+		return fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, expected, next)
+	}
+
+	err = s.inTx(ctx, func(tx querier) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE "+s.ident()+" SET status = :status, updated_at = :updated_at, version = version + 1"+statusTimeClause(next)+
+				" WHERE number = :number AND status = :expected AND deleted_at = ''",
+			sql.Named("status", next),
+			sql.Named("updated_at", s.now()),
+			sql.Named("number", number),
+			sql.Named("expected", expected))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			exists, err := s.exists(ctx, tx, number)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+			}
+			return fmt.Errorf("parcel %d: %w: expected %s", number, ErrStatusMismatch, expected)
+		}
+		return s.addHistory(ctx, tx, number, HistoryFieldStatus, string(expected), string(next))
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, expected, next)
+	return nil
+}
+
+// Ship отправляет посылку: проверяет, что она в статусе registered, переводит
+// её в статус sent и отмечает время отправки — всё в одной транзакции.
+// Для посылки не в статусе registered возвращается ErrInvalidStatusTransition.
+func (s ParcelStore) Ship(number int) error {
+	return s.ShipContext(context.Background(), number)
+}
+
+func (s ParcelStore) ShipContext(ctx context.Context, number int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Ship", start, err, slog.Int("number", number)) }()
+
+	return s.advance(ctx, number, ParcelStatusRegistered, ParcelStatusSent)
+}
+
+// Deliver отмечает доставку посылки: проверяет, что она в статусе sent,
+// переводит её в статус delivered и отмечает время доставки — всё в одной
+// транзакции. Для посылки не в статусе sent возвращается
+// ErrInvalidStatusTransition, и посылка не меняется.
+func (s ParcelStore) Deliver(number int) error {
+	return s.DeliverContext(context.Background(), number)
+}
+
+func (s ParcelStore) DeliverContext(ctx context.Context, number int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Deliver", start, err, slog.Int("number", number)) }()
+
+	return s.advance(ctx, number, ParcelStatusSent, ParcelStatusDelivered)
+}
+
+// advance переводит посылку из статуса from в статус to в одной транзакции.
+// Если посылка сейчас не в статусе from, возвращается ErrInvalidStatusTransition.
+func (s ParcelStore) advance(ctx context.Context, number int, from, to ParcelStatus) error {
+	err := s.inTx(ctx, func(tx querier) error {
+		current, _, err := s.currentStatus(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if current != from {
+			return fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, current, to)
+		}
+		_, err = s.setStatus(ctx, tx, number, to, anyVersion)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, from, to)
+	return nil
+}
+
+// ReRegister регистрирует заново возвращённую или просроченную посылку (статус
+// returned или expired): в одной транзакции переводит её в статус registered,
+// ставит время создания по часам хранилища и сбрасывает время отправки
+// и доставки и счётчик попыток доставки. Смена статуса записывается в историю.
+// Для посылки в другом статусе возвращается ErrInvalidStatusTransition.
+func (s ParcelStore) ReRegister(number int) error {
+	return s.ReRegisterContext(context.Background(), number)
+}
+
+func (s ParcelStore) ReRegisterContext(ctx context.Context, number int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "ReRegister", start, err, slog.Int("number", number)) }()
+
+	var old ParcelStatus
+	err = s.inTx(ctx, func(tx querier) error {
+		current, version, err := s.currentStatus(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if current != ParcelStatusReturned && current != ParcelStatusExpired {
+			return fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, current, ParcelStatusRegistered)
+		}
+
+		now := s.now()
+		res, err := tx.ExecContext(ctx,
+			"UPDATE "+s.ident()+" SET status = :status, created_at = :now, updated_at = :now, version = version + 1,"+
+				" shipped_at = '', delivered_at = '', attempts = 0"+
+				" WHERE number = :number AND version = :version AND deleted_at = ''",
+			sql.Named("status", ParcelStatusRegistered),
+			sql.Named("now", now),
+			sql.Named("number", number),
+			sql.Named("version", version))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("parcel %d changed concurrently: %w", number, ErrVersionConflict)
+		}
+		old = current
+		return s.addHistory(ctx, tx, number, HistoryFieldStatus, string(current), string(ParcelStatusRegistered))
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, old, ParcelStatusRegistered)
+	return nil
+}
+
+// defaultMaxDeliveryAttempts — число неудачных попыток доставки по умолчанию,
+// после которого посылка возвращается (см. WithMaxDeliveryAttempts)
+const defaultMaxDeliveryAttempts = 3
+
+// RecordDeliveryAttempt отмечает неудачную попытку доставки отправленной
+// посылки: атомарно увеличивает счётчик попыток и, когда он достигает
+// ограничения WithMaxDeliveryAttempts, в той же транзакции переводит посылку
+// в статус returned. Возвращает новое значение счётчика и статус посылки после
+// операции. Для посылки не в статусе sent возвращается ErrInvalidStatusTransition.
+func (s ParcelStore) RecordDeliveryAttempt(number int) (int, ParcelStatus, error) {
+	return s.RecordDeliveryAttemptContext(context.Background(), number)
+}
+
+func (s ParcelStore) RecordDeliveryAttemptContext(ctx context.Context, number int) (attempts int, status ParcelStatus, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "RecordDeliveryAttempt", start, err, slog.Int("number", number)) }()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		current, _, err := s.currentStatus(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if current != ParcelStatusSent {
+			return fmt.Errorf("parcel %d: %w: delivery attempt in status %s", number, ErrInvalidStatusTransition, current)
+		}
+
+		// статус повторяется в условии: посылка могла измениться после чтения
+		row := tx.QueryRowContext(ctx,
+			"UPDATE "+s.ident()+" SET attempts = attempts + 1, updated_at = :updated_at, version = version + 1"+
+				" WHERE number = :number AND status = :sent AND deleted_at = '' RETURNING attempts",
+			sql.Named("updated_at", s.now()),
+			sql.Named("number", number),
+			sql.Named("sent", ParcelStatusSent))
+		if err := row.Scan(&attempts); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("parcel %d changed concurrently: %w", number, ErrVersionConflict)
+			}
+			return err
+		}
+
+		status = ParcelStatusSent
+		if s.maxAttempts > 0 && attempts >= s.maxAttempts {
+			if _, err := s.setStatus(ctx, tx, number, ParcelStatusReturned, anyVersion); err != nil {
+				return err
+			}
+			status = ParcelStatusReturned
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	if status == ParcelStatusReturned {
+		s.statusChanged(number, ParcelStatusSent, ParcelStatusReturned)
+	}
+	return attempts, status, nil
+}
+
+// SetStatusMany переводит посылки с номерами numbers в статус status одним
+// запросом в одной транзакции и возвращает количество изменённых посылок.
+// Правила переходов проверяются для каждой посылки: если хотя бы одной посылки
+// нет или её нельзя перевести в status, не меняется ни одна, а ошибка
+// (ErrParcelNotFound или ErrInvalidStatusTransition) указывает на эту посылку.
+// Повторяющиеся номера учитываются один раз.
+func (s ParcelStore) SetStatusMany(numbers []int, status ParcelStatus) (int, error) {
+	return s.SetStatusManyContext(context.Background(), numbers, status)
+}
+
+func (s ParcelStore) SetStatusManyContext(ctx context.Context, numbers []int, status ParcelStatus) (_ int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetStatusMany", start, err, slog.Int("count", len(numbers)), slog.String("status", string(status)))
+	}()
+
+	var changed []Parcel
+	err = s.inTx(ctx, func(tx querier) error {
+		var err error
+		changed, err = s.setStatusMany(ctx, tx, numbers, status)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range changed {
+		s.statusChanged(p.Number, p.Status, status)
+	}
+	return len(changed), nil
+}
+
+// TransitionResult — итог TransitionBatch: номера посылок, переведённых в новый
+// статус, и причины отказа для остальных
+type TransitionResult struct {
+	// Succeeded — номера изменённых посылок в порядке запроса
+	Succeeded []int
+	// Rejected — ошибка для каждой посылки, которую перевести не удалось:
+	// ErrParcelNotFound, ErrInvalidStatusTransition или ErrVersionConflict
+	Rejected map[int]error
+}
+
+// TransitionBatch переводит посылки с номерами numbers в статус to в одной
+// транзакции, записывая каждое изменение в историю. В отличие от SetStatusMany,
+// посылка, которой нет или которую нельзя перевести в to, не отменяет остальные:
+// она попадает в Rejected. Ошибка возвращается, только если транзакция не удалась,
+// и тогда не меняется ни одна посылка. После фиксации обработчик WithOnStatusChange
+// вызывается для каждой изменённой посылки, а обработчик WithOnBatchTransition —
+// один раз с итогом всей пачки. Повторяющиеся номера учитываются один раз.
+func (s ParcelStore) TransitionBatch(numbers []int, to ParcelStatus) (TransitionResult, error) {
+	return s.TransitionBatchContext(context.Background(), numbers, to)
+}
+
+func (s ParcelStore) TransitionBatchContext(ctx context.Context, numbers []int, to ParcelStatus) (res TransitionResult, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "TransitionBatch", start, err, slog.Int("count", len(numbers)),
+			slog.String("status", string(to)), slog.Int("rejected", len(res.Rejected)))
+	}()
+
+	var old []ParcelStatus
+	err = s.inTx(ctx, func(tx querier) error {
+		// транзакция может повториться, поэтому итог собирается заново
+		res = TransitionResult{Succeeded: []int{}, Rejected: map[int]error{}}
+		old = nil
+		seen := make(map[int]bool, len(numbers))
+		for _, number := range numbers {
+			if seen[number] {
+				continue
+			}
+			seen[number] = true
+
+			prev, err := s.setStatus(ctx, tx, number, to, anyVersion)
+			switch {
+			case err == nil:
+				res.Succeeded = append(res.Succeeded, number)
+				old = append(old, prev)
+			case errors.Is(err, ErrParcelNotFound), errors.Is(err, ErrInvalidStatusTransition),
+				errors.Is(err, ErrVersionConflict):
+				res.Rejected[number] = err
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return TransitionResult{}, err
+	}
+	for i, number := range res.Succeeded {
+		s.statusChanged(number, old[i], to)
+	}
+	if s.onBatch != nil {
+		s.onBatch(res)
+	}
+	return res, nil
+}
+
+// ExpireStale переводит в статус expired посылки, которые пробыли в статусе
+// registered дольше olderThan: созданные раньше, чем olderThan назад по часам
+// хранилища. Посылки меняются одним запросом в одной транзакции, каждое
+// изменение записывается в историю. Возвращает количество изменённых посылок.
+func (s ParcelStore) ExpireStale(olderThan time.Duration) (int, error) {
+	return s.ExpireStaleContext(context.Background(), olderThan)
+}
+
+func (s ParcelStore) ExpireStaleContext(ctx context.Context, olderThan time.Duration) (_ int, err error) {
+	var expired []int
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "ExpireStale", start, err, slog.Duration("older_than", olderThan), slog.Int("expired", len(expired)))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		var err error
+		expired, err = s.expireStale(ctx, tx, s.clock().Add(-olderThan))
+		return err
+	})
+	if err != nil {
+		expired = nil
+		return 0, err
+	}
+	for _, number := range expired {
+		s.statusChanged(number, ParcelStatusRegistered, ParcelStatusExpired)
+	}
+	return len(expired), nil
+}
+
+// expireStale переводит в статус expired посылки в статусе registered, созданные
+// раньше before, и возвращает их номера. Выполняется внутри транзакции.
+func (s ParcelStore) expireStale(ctx context.Context, tx querier, before time.Time) ([]int, error) {
+	rows, err := tx.QueryContext(ctx,
+		"UPDATE "+s.ident()+" SET status = :expired, updated_at = :updated_at, version = version + 1"+
+			" WHERE status = :registered AND created_at < :before AND deleted_at = '' RETURNING number",
+		sql.Named("expired", ParcelStatusExpired),
+		sql.Named("updated_at", s.now()),
+		sql.Named("registered", ParcelStatusRegistered),
+		sql.Named("before", formatTime(before)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var numbers []int
+	for rows.Next() {
+		var number int
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// в транзакции SQLite одно соединение: история пишется после чтения всех строк
+	rows.Close()
+
+	for _, number := range numbers {
+		if err := s.addHistory(ctx, tx, number, HistoryFieldStatus, string(ParcelStatusRegistered), string(ParcelStatusExpired)); err != nil {
+			return nil, err
+		}
+	}
+	return numbers, nil
+}
+
+// statusTimeClause возвращает добавку к SET, отмечающую время отправки или
+// доставки, если посылка переводится в статус sent или delivered.
+// Время берётся из параметра :updated_at.
+func statusTimeClause(status ParcelStatus) string {
+	switch status {
+	case ParcelStatusSent:
+		return ", shipped_at = :updated_at"
+	case ParcelStatusDelivered:
+		return ", delivered_at = :updated_at"
+	}
+	return ""
+}
+
+// setStatusMany проверяет переходы и меняет статус посылок, возвращая их
+// состояние до изменения в порядке numbers без повторов. Выполняется внутри
+// транзакции.
+func (s ParcelStore) setStatusMany(ctx context.Context, tx querier, numbers []int, status ParcelStatus) ([]Parcel, error) {
+	if len(numbers) == 0 {
+		return nil, nil
+	}
+
+	in, args := inClause("number", numbers)
+	parcels, err := queryParcels(ctx, tx,
+		"SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE number IN ("+in+") AND deleted_at = ''", args...)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int]Parcel, len(parcels))
+	for _, p := range parcels {
+		current[p.Number] = p
+	}
+	changed := make([]Parcel, 0, len(current))
+	seen := make(map[int]bool, len(current))
+	for _, number := range numbers {
+		p, ok := current[number]
+		if !ok {
+			return nil, fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+		}
+		if !canTransition(p.Status, status) {
+			return nil, fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, p.Status, status)
+		}
+		if !seen[number] {
+			seen[number] = true
+			changed = append(changed, p)
+		}
+	}
+
+	// условие на исходные статусы повторяется в UPDATE: в PostgreSQL при
+	// READ COMMITTED посылки могут измениться между чтением и записью
+	from, fromArgs := inClause("from", sourceStatuses(status))
+	args = append(args, fromArgs...)
+	args = append(args, sql.Named("status", status), sql.Named("updated_at", s.now()))
+	res, err := tx.ExecContext(ctx,
+		"UPDATE "+s.ident()+" SET status = :status, updated_at = :updated_at, version = version + 1"+statusTimeClause(status)+
+			" WHERE number IN ("+in+") AND status IN ("+from+") AND deleted_at = ''",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if int(n) != len(changed) {
+		return nil, fmt.Errorf("parcels changed concurrently: %w", ErrVersionConflict)
+	}
+
+	for _, p := range changed {
+		if err := s.addHistory(ctx, tx, p.Number, HistoryFieldStatus, string(p.Status), string(status)); err != nil {
+			return nil, err
+		}
+	}
+	return changed, nil
+}
+
+// SetStatusAndAddress атомарно меняет статус и адрес посылки. Действуют те же
+// правила, что и в SetStatus и SetAddress: переход статуса проверяется по
+// statusTransitions, а адрес можно сменить только у посылки в статусе registered,
+// иначе возвращается ErrAddressChangeNotAllowed. При ошибке посылка не меняется.
+func (s ParcelStore) SetStatusAndAddress(number int, status ParcelStatus, address string) error {
+	return s.SetStatusAndAddressContext(context.Background(), number, status, address)
+}
+
+func (s ParcelStore) SetStatusAndAddressContext(ctx context.Context, number int, status ParcelStatus, address string) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetStatusAndAddress", start, err, slog.Int("number", number),
+			slog.String("status", string(status)), slog.String("address", truncate(address)))
+	}()
+
+	address = NormalizeAddress(address)
+	if err := checkAddressLength(address, s.maxAddressLen); err != nil {
+		return err
+	}
+	var old ParcelStatus
+	err = s.inTx(ctx, func(tx querier) error {
+		current, err := s.getParcel(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if !canTransition(current.Status, status) {
+			return fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, current.Status, status)
+		}
+		if current.Status != ParcelStatusRegistered {
+			return fmt.Errorf("parcel %d in status %s: %w", number, current.Status, ErrAddressChangeNotAllowed)
+		}
+
+		// версию увеличивает setStatus, адрес меняется в той же транзакции
+		if old, err = s.setStatus(ctx, tx, number, status, anyVersion); err != nil {
+			return err
+		}
+		// как и в SetAddress, тот же адрес не перезаписывается и не попадает в историю
+		if address == current.Address {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE "+s.ident()+" SET address = :address WHERE number = :number",
+			sql.Named("address", address),
+			sql.Named("number", number))
+		if err != nil {
+			return err
+		}
+		return s.addHistory(ctx, tx, number, HistoryFieldAddress, current.Address, address)
+	})
+	if err != nil {
+		return err
+	}
+	s.statusChanged(number, old, status)
+	return nil
+}
+
+// SetAddress меняет адрес посылки в статусе registered; адрес посылок в других
+// статусах молча не меняется. Если нормализованный адрес совпадает с текущим,
+// SetAddress тоже просто завершается успешно: посылка не перезаписывается,
+// её версия не растёт и в историю ничего не попадает.
+func (s ParcelStore) SetAddress(number int, address string) error {
+	return s.SetAddressContext(context.Background(), number, address)
+}
+
+func (s ParcelStore) SetAddressContext(ctx context.Context, number int, address string) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetAddress", start, err, slog.Int("number", number), slog.String("address", truncate(address)))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		return s.setAddress(ctx, tx, number, address, anyVersion)
+	})
+	// адрес посылки не в статусе registered SetAddress молча не меняет
+	if errors.Is(err, ErrAddressChangeNotAllowed) {
+		return nil
+	}
+	return err
+}
+
+// SetAddressIfVersion меняет адрес посылки, только если её версия равна version.
+// Если посылку успели изменить, возвращается ErrVersionConflict; если посылка
+// не в статусе registered — ErrAddressChangeNotAllowed.
+func (s ParcelStore) SetAddressIfVersion(number int, address string, version int) error {
+	return s.SetAddressIfVersionContext(context.Background(), number, address, version)
+}
+
+func (s ParcelStore) SetAddressIfVersionContext(ctx context.Context, number int, address string, version int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetAddressIfVersion", start, err, slog.Int("number", number),
+			slog.String("address", truncate(address)), slog.Int("version", version))
+	}()
+
+	return s.inTx(ctx, func(tx querier) error {
+		return s.setAddress(ctx, tx, number, address, version)
+	})
+}
+
+// setAddress меняет адрес посылки в статусе registered, увеличивая её версию,
+// и записывает изменение в историю. Адрес предварительно нормализуется; если
+// он не изменился, посылка не перезаписывается. Выполняется внутри транзакции.
+// При version == anyVersion версия вызывающим не проверяется.
+func (s ParcelStore) setAddress(ctx context.Context, tx querier, number int, address string, version int) error {
+	address = NormalizeAddress(address)
+	if err := checkAddressLength(address, s.maxAddressLen); err != nil {
+		return err
+	}
+	current, err := s.getParcel(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+
+	if version != anyVersion && version != current.Version {
+		return fmt.Errorf("parcel %d: %w: expected version %d, got %d", number, ErrVersionConflict, version, current.Version)
+	}
+	if current.Status != ParcelStatusRegistered {
+		return fmt.Errorf("parcel %d in status %s: %w", number, current.Status, ErrAddressChangeNotAllowed)
+	}
+	if address == current.Address {
+		return nil
+	}
+
+	// прочитанная версия повторяется в условии UPDATE, чтобы в историю попал
+	// именно тот адрес, который был заменён
+	res, err := tx.ExecContext(ctx,
+		"UPDATE "+s.ident()+" SET address = :address, updated_at = :updated_at, version = version + 1"+
+			" WHERE number = :number AND status = :status AND version = :version AND deleted_at = ''",
+		sql.Named("address", address),
+		sql.Named("updated_at", s.now()),
+		sql.Named("number", number),
+		sql.Named("status", ParcelStatusRegistered),
+		sql.Named("version", current.Version))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("parcel %d changed concurrently: %w", number, ErrVersionConflict)
+	}
+	return s.addHistory(ctx, tx, number, HistoryFieldAddress, current.Address, address)
+}
+
+// SetClient переводит посылку другому клиенту, например если она была создана
+// не на тот аккаунт. Статус посылки при этом не важен. newClient должен быть
+// положительным, иначе возвращается ErrInvalidParcel. Переназначение
+// записывается в историю; если клиент не меняется, посылка не перезаписывается.
+func (s ParcelStore) SetClient(number, newClient int) error {
+	return s.SetClientContext(context.Background(), number, newClient)
+}
+
+func (s ParcelStore) SetClientContext(ctx context.Context, number, newClient int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "SetClient", start, err, slog.Int("number", number), slog.Int("client", newClient))
+	}()
+
+	if newClient <= 0 {
+		return fmt.Errorf("%w: client must be positive, got %d", ErrInvalidParcel, newClient)
+	}
+
+	return s.inTx(ctx, func(tx querier) error {
+		current, err := s.getParcel(ctx, tx, number)
+		if err != nil {
+			return err
+		}
+		if current.Client == newClient {
+			return nil
+		}
+
+		res, err := tx.ExecContext(ctx,
+			"UPDATE "+s.ident()+" SET client = :client, updated_at = :updated_at, version = version + 1"+
+				" WHERE number = :number AND version = :version AND deleted_at = ''",
+			sql.Named("client", newClient),
+			sql.Named("updated_at", s.now()),
+			sql.Named("number", number),
+			sql.Named("version", current.Version))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("parcel %d changed concurrently: %w", number, ErrVersionConflict)
+		}
+		return s.addHistory(ctx, tx, number, HistoryFieldClient, strconv.Itoa(current.Client), strconv.Itoa(newClient))
+	})
+}
+
+// SetMetadata заменяет метаданные посылки на md целиком, независимо от её
+// статуса; nil или пустая карта очищает их. В историю изменение не пишется.
+func (s ParcelStore) SetMetadata(number int, md map[string]string) error {
+	return s.SetMetadataContext(context.Background(), number, md)
+}
+
+func (s ParcelStore) SetMetadataContext(ctx context.Context, number int, md map[string]string) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "SetMetadata", start, err, slog.Int("number", number)) }()
+
+	metadata, err := encodeMetadata(md)
+	if err != nil {
+		return fmt.Errorf("%w: metadata: %w", ErrInvalidParcel, err)
+	}
+
+	return s.inTx(ctx, func(tx querier) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE "+s.ident()+" SET metadata = :metadata, updated_at = :updated_at, version = version + 1"+
+				" WHERE number = :number AND deleted_at = ''",
+			sql.Named("metadata", metadata),
+			sql.Named("updated_at", s.now()),
+			sql.Named("number", number))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+		}
+		return nil
+	})
+}
+
+// SetDeliveryWindow задаёт окно доставки посылки. nil снимает
+// соответствующий край окна; если оба края заданы, after должно быть раньше
+// before, иначе возвращается ErrInvalidDeliveryWindow. Для отсутствующей
+// посылки возвращается ErrParcelNotFound. В историю изменение не пишется.
+func (s ParcelStore) SetDeliveryWindow(number int, after, before *time.Time) error {
+	return s.SetDeliveryWindowContext(context.Background(), number, after, before)
+}
+
+func (s ParcelStore) SetDeliveryWindowContext(ctx context.Context, number int, after, before *time.Time) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "SetDeliveryWindow", start, err, slog.Int("number", number)) }()
+
+	if err := checkDeliveryWindow(after, before); err != nil {
+		return err
+	}
+
+	return s.inTx(ctx, func(tx querier) error {
+		res, err := tx.ExecContext(ctx,
+			"UPDATE "+s.ident()+" SET deliver_after = :after, deliver_before = :before,"+
+				" updated_at = :updated_at, version = version + 1 WHERE number = :number AND deleted_at = ''",
+			sql.Named("after", nullTime(after)),
+			sql.Named("before", nullTime(before)),
+			sql.Named("updated_at", s.now()),
+			sql.Named("number", number))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+		}
+		return nil
+	})
+}
+
+func (s ParcelStore) Delete(number int) error {
+	return s.DeleteContext(context.Background(), number)
+}
+
+// DeleteContext удаляет посылку. Удалить можно только посылку в статусе registered,
+// для остальных возвращается ErrDeleteNotAllowed.
+func (s ParcelStore) DeleteContext(ctx context.Context, number int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Delete", start, err, slog.Int("number", number)) }()
+
+	return s.inTx(ctx, func(tx querier) error {
+		return s.deleteParcel(ctx, tx, number)
+	})
+}
+
+// deleteParcel удаляет посылку в статусе registered. Выполняется внутри транзакции.
+func (s ParcelStore) deleteParcel(ctx context.Context, tx querier, number int) error {
+	return s.removeParcel(ctx, tx, number,
+		"DELETE FROM "+s.ident()+" WHERE number = :number AND status = :status",
+		sql.Named("number", number),
+		sql.Named("status", ParcelStatusRegistered))
+}
+
+// softDeleteParcel помечает посылку в статусе registered удалённой.
+// Выполняется внутри транзакции.
+func (s ParcelStore) softDeleteParcel(ctx context.Context, tx querier, number int) error {
+	now := s.now()
+	return s.removeParcel(ctx, tx, number,
+		"UPDATE "+s.ident()+" SET deleted_at = :deleted_at, updated_at = :deleted_at, version = version + 1"+
+			" WHERE number = :number AND status = :status AND deleted_at = ''",
+		sql.Named("deleted_at", now),
+		sql.Named("number", number),
+		sql.Named("status", ParcelStatusRegistered))
+}
+
+// removeParcel проверяет, что посылку можно удалить, и выполняет запрос query,
+// удаляющий её. Запрос должен повторять условие на статус registered:
+// в PostgreSQL при READ COMMITTED статус может смениться между чтением и удалением.
+func (s ParcelStore) removeParcel(ctx context.Context, tx querier, number int, query string, args ...any) error {
+	status, _, err := s.currentStatus(ctx, tx, number)
+	if err != nil {
+		return err
+	}
+
+	if status != ParcelStatusRegistered {
+		return fmt.Errorf("parcel %d in status %s: %w", number, status, ErrDeleteNotAllowed)
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("parcel %d status changed concurrently: %w", number, ErrDeleteNotAllowed)
+	}
+	return s.addHistory(ctx, tx, number, HistoryFieldDeleted, "false", "true")
+}
+
+// SoftDelete помечает посылку удалённой, не стирая её из базы. Действуют те же
+// правила, что и в Delete. Помеченная посылка не возвращается методами чтения
+// и не меняется, как если бы её не было; окончательно её удаляет PurgeDeletedBefore.
+func (s ParcelStore) SoftDelete(number int) error {
+	return s.SoftDeleteContext(context.Background(), number)
+}
+
+func (s ParcelStore) SoftDeleteContext(ctx context.Context, number int) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "SoftDelete", start, err, slog.Int("number", number)) }()
+
+	return s.inTx(ctx, func(tx querier) error {
+		return s.softDeleteParcel(ctx, tx, number)
+	})
+}
+
+// PurgeDeletedBefore окончательно удаляет посылки, помеченные удалёнными раньше t,
+// и возвращает их количество. Удаление каждой посылки записывается в историю.
+func (s ParcelStore) PurgeDeletedBefore(t time.Time) (int, error) {
+	return s.PurgeDeletedBeforeContext(context.Background(), t)
+}
+
+func (s ParcelStore) PurgeDeletedBeforeContext(ctx context.Context, t time.Time) (_ int, err error) {
+	var purged int64
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "PurgeDeletedBefore", start, err, slog.Time("before", t), slog.Int64("purged", purged))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		numbers, err := s.removeParcels(ctx, tx, " WHERE deleted_at <> '' AND deleted_at < :before", "true", "purged",
+			sql.Named("before", formatTime(t)))
+		purged = int64(len(numbers))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(purged), nil
+}
+
+// Условия, по которым DeleteByClient и DeleteOlderThan выбирают удаляемые
+// посылки. Count-методы используют те же условия, чтобы их результат совпадал
+// с количеством удалённых.
+const (
+	deleteByClientWhere  = " WHERE client = :client AND status = :status AND deleted_at = ''"
+	deleteOlderThanWhere = " WHERE created_at < :before AND status = :status AND deleted_at = ''"
 )
 
-type ParcelStore struct {
-	db *sql.DB
+// DeleteByClient удаляет посылки клиента и возвращает количество удалённых.
+// Как и Delete, удаляет только посылки в статусе registered — отправленные
+// и доставленные посылки остаются — и записывает удаление каждой в историю.
+func (s ParcelStore) DeleteByClient(client int) (int, error) {
+	return s.DeleteByClientContext(context.Background(), client)
 }
 
-func NewParcelStore(db *sql.DB) ParcelStore {
-	return ParcelStore{db: db}
+func (s ParcelStore) DeleteByClientContext(ctx context.Context, client int) (_ int, err error) {
+	var deleted int64
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "DeleteByClient", start, err, slog.Int("client", client), slog.Int64("deleted", deleted))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		numbers, err := s.removeParcels(ctx, tx, deleteByClientWhere, "false", "true",
+			sql.Named("client", client),
+			sql.Named("status", ParcelStatusRegistered))
+		deleted = int64(len(numbers))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
 }
 
-func (s ParcelStore) Add(p Parcel) (int, error) {
-	res, err := s.db.Exec(
-		`INSERT INTO parcel (client, status, address, created_at) 
-		VALUES (:client, :status, :address, :created_at)`,
-		sql.Named("client", p.Client),
-		sql.Named("status", p.Status),
-		sql.Named("address", p.Address),
-		sql.Named("created_at", p.CreatedAt))
+// DeleteOlderThan удаляет посылки, созданные раньше t, и возвращает количество
+// удалённых. Граница приводится к UTC, как в GetByDateRange. Действует то же
+// правило, что в Delete и DeleteByClient: удаляются только посылки в статусе
+// registered, а отправленные и доставленные остаются. Удаление каждой посылки
+// записывается в историю. Удаление выполняется в одной транзакции
+// и прерывается отменой ctx.
+func (s ParcelStore) DeleteOlderThan(ctx context.Context, t time.Time) (_ int, err error) {
+	var deleted int64
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() {
+		err = s.observe(ctx, "DeleteOlderThan", start, err, slog.Time("before", t), slog.Int64("deleted", deleted))
+	}()
+
+	err = s.inTx(ctx, func(tx querier) error {
+		numbers, err := s.removeParcels(ctx, tx, deleteOlderThanWhere, "false", "true",
+			sql.Named("before", formatTime(t)),
+			sql.Named("status", ParcelStatusRegistered))
+		deleted = int64(len(numbers))
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
+	return int(deleted), nil
+}
 
-	id, err := res.LastInsertId()
+// removeParcels удаляет посылки, подходящие под условие where, и записывает
+// в историю удаление каждой из них со значениями oldValue и newValue.
+// Возвращает номера удалённых посылок. Выполняется внутри транзакции.
+func (s ParcelStore) removeParcels(ctx context.Context, tx querier, where, oldValue, newValue string, args ...any) ([]int, error) {
+	rows, err := tx.QueryContext(ctx, "DELETE FROM "+s.ident()+where+" RETURNING number", args...)
 	if err != nil {
-		return 0, nil
+		return nil, err
 	}
-	return int(id), nil
+	defer rows.Close()
+
+	var numbers []int
+	for rows.Next() {
+		var number int
+		if err := rows.Scan(&number); err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// в транзакции SQLite одно соединение: история пишется после чтения всех строк
+	rows.Close()
+
+	for _, number := range numbers {
+		if err := s.addHistory(ctx, tx, number, HistoryFieldDeleted, oldValue, newValue); err != nil {
+			return nil, err
+		}
+	}
+	return numbers, nil
 }
 
-func (s ParcelStore) Get(number int) (Parcel, error) {
-	row := s.db.QueryRow("SELECT * FROM parcel WHERE number = :number", sql.Named("number", number))
-	p := Parcel{}
-	err := row.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+// CountDeletableByClient возвращает количество посылок, которые удалил бы
+// DeleteByClient, ничего не удаляя. Позволяет проверить масштаб удаления заранее.
+func (s ParcelStore) CountDeletableByClient(client int) (int, error) {
+	return s.CountDeletableByClientContext(context.Background(), client)
+}
+
+func (s ParcelStore) CountDeletableByClientContext(ctx context.Context, client int) (count int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "CountDeletableByClient", start, err, slog.Int("client", client)) }()
+
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.ident()+deleteByClientWhere,
+		sql.Named("client", client),
+		sql.Named("status", ParcelStatusRegistered))
+	if err = row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// CountOlderThan возвращает количество посылок, которые удалил бы
+// DeleteOlderThan с той же границей t, ничего не удаляя.
+func (s ParcelStore) CountOlderThan(ctx context.Context, t time.Time) (count int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "CountOlderThan", start, err, slog.Time("before", t)) }()
+
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.ident()+deleteOlderThanWhere,
+		sql.Named("before", formatTime(t)),
+		sql.Named("status", ParcelStatusRegistered))
+	if err = row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// TruncateAll удаляет все посылки, включая помеченные удалёнными, и всю
+// историю изменений и сбрасывает счётчик номеров, так что следующий Add
+// получит номер 1. Операция необратима и предназначена для тестов и
+// администрирования: в рабочем коде её лучше не вызывать. Выполняется
+// в одной транзакции.
+func (s ParcelStore) TruncateAll() error {
+	return s.TruncateAllContext(context.Background())
+}
+
+func (s ParcelStore) TruncateAllContext(ctx context.Context) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "TruncateAll", start, err) }()
+
+	return s.inTx(ctx, func(tx querier) error {
+		if s.dialect == DialectPostgres {
+			_, err := tx.ExecContext(ctx, "TRUNCATE "+s.ident()+", "+s.historyTable()+" RESTART IDENTITY")
+			return err
+		}
+
+		for _, table := range []string{s.ident(), s.historyTable()} {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM sqlite_sequence WHERE name IN (:table, :history)",
+			sql.Named("table", s.table),
+			sql.Named("history", s.table+"_history"))
+		return err
+	})
+}
+
+// querier — общая часть *sql.DB и *sql.Tx, через которую выполняются запросы
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// parcelColumns — список колонок в порядке, который ожидает scanParcel
+const parcelColumns = "number, client, status, address, created_at, updated_at, version, shipped_at, delivered_at, idempotency_key, weight, metadata, attempts, deliver_after, deliver_before"
+
+// scanner — общая часть *sql.Row и *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanParcel(row scanner) (Parcel, error) {
+	var (
+		p                           Parcel
+		metadata                    string
+		deliverAfter, deliverBefore sql.NullString
+	)
+	err := row.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt, &p.UpdatedAt, &p.Version, &p.ShippedAt, &p.DeliveredAt, &p.IdempotencyKey, &p.Weight, &metadata, &p.Attempts, &deliverAfter, &deliverBefore)
 	if err != nil {
 		return Parcel{}, err
 	}
+	p.DeliverAfter, p.DeliverBefore = deliverAfter.String, deliverBefore.String
+	p.Metadata, err = decodeMetadata(metadata)
+	if err != nil {
+		return Parcel{}, fmt.Errorf("parcel %d: metadata: %w", p.Number, err)
+	}
 	return p, nil
 }
 
-func (s ParcelStore) GetByClient(client int) ([]Parcel, error) {
-	var res []Parcel
-	rows, err := s.db.Query("SELECT * FROM parcel WHERE client = :client", sql.Named("client", client))
+// encodeMetadata кодирует метаданные посылки в JSON для колонки metadata;
+// nil и пустая карта кодируются как {}
+func encodeMetadata(md map[string]string) (string, error) {
+	if len(md) == 0 {
+		return "{}", nil
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeMetadata разбирает колонку metadata; для пустых метаданных возвращается nil
+func decodeMetadata(s string) (map[string]string, error) {
+	if s == "" || s == "{}" {
+		return nil, nil
+	}
+	var md map[string]string
+	if err := json.Unmarshal([]byte(s), &md); err != nil {
+		return nil, err
+	}
+	if len(md) == 0 {
+		return nil, nil
+	}
+	return md, nil
+}
+
+func (s ParcelStore) getParcel(ctx context.Context, q querier, number int) (Parcel, error) {
+	row := q.QueryRowContext(ctx, "SELECT "+parcelColumns+" FROM "+s.ident()+" WHERE number = :number AND deleted_at = ''",
+		sql.Named("number", number))
+	p, err := scanParcel(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Parcel{}, fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+	}
+	if err != nil {
+		return Parcel{}, err
+	}
+	return p, nil
+}
+
+// currentStatus возвращает текущие статус и версию посылки или ErrParcelNotFound
+func (s ParcelStore) currentStatus(ctx context.Context, q querier, number int) (ParcelStatus, int, error) {
+	var (
+		status  ParcelStatus
+		version int
+	)
+	row := q.QueryRowContext(ctx, "SELECT status, version FROM "+s.ident()+" WHERE number = :number AND deleted_at = ''",
+		sql.Named("number", number))
+	err := row.Scan(&status, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, fmt.Errorf("parcel %d: %w", number, ErrParcelNotFound)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return status, version, nil
+}
+
+// anyVersion передаётся в setStatus, когда вызывающий не проверяет версию:
+// сверяется только версия, прочитанная в той же транзакции
+const anyVersion = 0
+
+// setStatus проверяет версию и допустимость перехода и меняет статус посылки,
+// увеличивая её версию, и возвращает предыдущий статус. Выполняется внутри
+// транзакции, чтобы проверка и изменение были атомарны.
+// При version == anyVersion версия вызывающим не проверяется.
+func (s ParcelStore) setStatus(ctx context.Context, tx querier, number int, status ParcelStatus, version int) (ParcelStatus, error) {
+	current, currentVersion, err := s.currentStatus(ctx, tx, number)
+	if err != nil {
+		return "", err
+	}
+
+	if version != anyVersion && version != currentVersion {
+		return "", fmt.Errorf("parcel %d: %w: expected version %d, got %d", number, ErrVersionConflict, version, currentVersion)
+	}
+	if !canTransition(current, status) {
+		return "", fmt.Errorf("parcel %d: %w: %s -> %s", number, ErrInvalidStatusTransition, current, status)
+	}
+
+	// прочитанные статус и версия повторяются в условии UPDATE: в PostgreSQL
+	// при READ COMMITTED посылка может измениться между чтением и записью
+	res, err := tx.ExecContext(ctx,
+		"UPDATE "+s.ident()+" SET status = :status, updated_at = :updated_at, version = version + 1"+statusTimeClause(status)+
+			" WHERE number = :number AND status = :current AND version = :version",
+		sql.Named("status", status),
+		sql.Named("updated_at", s.now()),
+		sql.Named("number", number),
+		sql.Named("current", current),
+		sql.Named("version", currentVersion))
+	if err != nil {
+		return "", err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if n == 0 {
+		return "", fmt.Errorf("parcel %d changed concurrently: %w", number, ErrVersionConflict)
+	}
+	if err := s.addHistory(ctx, tx, number, HistoryFieldStatus, string(current), string(status)); err != nil {
+		return "", err
+	}
+	return current, nil
+}
+
+// statusChanged вызывает обработчик смены статуса, если он задан.
+// Вызывается только после фиксации транзакции.
+func (s ParcelStore) statusChanged(number int, old, new ParcelStatus) {
+	if s.onStatusChange != nil {
+		s.onStatusChange(number, old, new)
+	}
+}
+
+// inClause возвращает список параметров :prefix0, :prefix1, ... для условия IN
+// и соответствующие им аргументы
+func inClause[T any](prefix string, values []T) (string, []any) {
+	params := make([]string, len(values))
+	args := make([]any, len(values))
+	for i, v := range values {
+		name := prefix + strconv.Itoa(i)
+		params[i] = ":" + name
+		args[i] = sql.Named(name, v)
+	}
+	return strings.Join(params, ", "), args
+}
+
+// likeEscaper экранирует спецсимволы шаблона LIKE; экранирующий символ — обратная косая черта
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// queryParcels выполняет запрос, выбирающий parcelColumns, и возвращает посылки.
+// Если ничего не найдено, возвращается пустой срез.
+func queryParcels(ctx context.Context, q querier, query string, args ...any) ([]Parcel, error) {
+	res := []Parcel{}
+	err := iterParcels(ctx, q, func(p Parcel) error {
+		res = append(res, p)
+		return nil
+	}, query, args...)
+	return res, err
+}
+
+// iterParcels выполняет запрос и вызывает fn для каждой посылки по мере чтения
+// строк. Если fn вернула ошибку, чтение прекращается и ошибка возвращается как есть.
+func iterParcels(ctx context.Context, q querier, fn func(Parcel) error, query string, args ...any) error {
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
-		return res, err
+		return err
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		var p Parcel
-		err := rows.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+		p, err := scanParcel(rows)
 		if err != nil {
-			return res, err
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
 		}
-		res = append(res, p)
 	}
+	return rows.Err()
+}
 
-	if err := rows.Err(); err != nil {
-		return res, err
+// now возвращает текущее время по часам хранилища в формате, в котором
+// хранятся отметки времени
+func (s ParcelStore) now() string {
+	return formatTime(s.clock())
+}
+
+// formatTime приводит время к формату хранения: RFC3339 в UTC
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// nullString возвращает значение для колонки, допускающей NULL:
+// пустая строка хранится как NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullTime возвращает отметку времени в формате хранения или NULL для nil
+func nullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
 	}
-	return res, nil
+	return nullString(formatTime(*t))
 }
 
-func (s ParcelStore) SetStatus(number int, status string) error {
-	_, err := s.db.Exec("UPDATE parcel SET status = :status WHERE number = :number",
-		sql.Named("status", status),
-		sql.Named("number", number))
-	if err != nil {
-		return err
+// addParcel нормализует адрес и проверяет посылку, добавляет её через q
+// и возвращает её номер.
+// Если время создания не задано, оно берётся по часам хранилища; заданное
+// вызывающим время приводится к UTC.
+// Версия новой посылки всегда 1. Номер, если он не задан явно, выбирает
+// распределитель WithNumberAllocator. Если у посылки задан ключ идемпотентности
+// и у клиента уже есть посылка с тем же ключом, возвращается её номер.
+// LastInsertId в драйверах PostgreSQL не поддерживается, поэтому там номер
+// возвращается через RETURNING.
+func (s ParcelStore) addParcel(ctx context.Context, q querier, p Parcel) (int, error) {
+	p.Address = NormalizeAddress(p.Address)
+	if err := p.Validate(); err != nil {
+		return 0, err
+	}
+	if err := checkAddressLength(p.Address, s.maxAddressLen); err != nil {
+		return 0, err
+	}
+	if err := p.normalizeTimestamps(); err != nil {
+		return 0, err
+	}
+	if p.CreatedAt == "" {
+		p.CreatedAt = s.now()
+	}
+	if p.UpdatedAt == "" {
+		p.UpdatedAt = p.CreatedAt
+	}
+
+	if p.IdempotencyKey != "" {
+		id, err := s.findByIdempotencyKey(ctx, q, p.Client, p.IdempotencyKey)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return 0, err
+		}
+	}
+
+	if p.Number <= 0 {
+		number, err := s.allocateNumber(ctx, q, p)
+		if err != nil {
+			return 0, err
+		}
+		p.Number = number
+	}
+
+	id, err := s.insertParcel(ctx, q, p)
+	if err != nil && p.IdempotencyKey != "" {
+		// посылку с тем же ключом мог успеть добавить параллельный вызов,
+		// тогда вставка нарушила уникальный индекс
+		if existing, findErr := s.findByIdempotencyKey(ctx, q, p.Client, p.IdempotencyKey); findErr == nil {
+			return existing, nil
+		}
+	}
+	return id, err
+}
+
+// defaultMaxAddressLength — ограничение длины адреса по умолчанию,
+// совпадающее с размером колонки address
+const defaultMaxAddressLength = 512
+
+// checkAddressLength проверяет, что нормализованный адрес не длиннее max
+// символов (не байтов). При max <= 0 длина не ограничена.
+func checkAddressLength(address string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	if n := utf8.RuneCountInString(address); n > max {
+		return fmt.Errorf("%w: %d characters, max %d", ErrAddressTooLong, n, max)
 	}
 	return nil
 }
 
-func (s ParcelStore) SetAddress(number int, address string) error {
-	_, err := s.db.Exec("UPDATE parcel SET address = :address WHERE number = :number AND status = :status",
-		sql.Named("address", address),
-		sql.Named("number", number),
-		sql.Named("status", "registered"))
+// findByIdempotencyKey возвращает номер неудалённой посылки клиента с ключом
+// идемпотентности key или sql.ErrNoRows
+func (s ParcelStore) findByIdempotencyKey(ctx context.Context, q querier, client int, key string) (int, error) {
+	var id int
+	err := q.QueryRowContext(ctx,
+		"SELECT number FROM "+s.ident()+" WHERE client = :client AND idempotency_key = :key AND deleted_at = ''",
+		sql.Named("client", client),
+		sql.Named("key", key)).Scan(&id)
+	return id, err
+}
+
+// insertParcel вставляет подготовленную addParcel посылку и возвращает её номер.
+// Положительный p.Number вставляется как есть, например при восстановлении
+// из резервной копии; если номер занят, возвращается ErrDuplicateNumber.
+// В PostgreSQL явный номер не сдвигает последовательность serial.
+func (s ParcelStore) insertParcel(ctx context.Context, q querier, p Parcel) (int, error) {
+	columns, values := "", ""
+	if p.Number > 0 {
+		columns, values = "number, ", ":number, "
+	}
+	metadata, err := encodeMetadata(p.Metadata)
+	if err != nil {
+		return 0, fmt.Errorf("%w: metadata: %w", ErrInvalidParcel, err)
+	}
+
+	query := "INSERT INTO " + s.ident() + " (" + columns + `client, status, address, created_at, updated_at, version, idempotency_key, weight, metadata, deliver_after, deliver_before)
+		VALUES (` + values + `:client, :status, :address, :created_at, :updated_at, 1, :idempotency_key, :weight, :metadata, :deliver_after, :deliver_before)`
+	args := []any{
+		sql.Named("number", p.Number),
+		sql.Named("client", p.Client),
+		sql.Named("status", p.Status),
+		sql.Named("address", p.Address),
+		sql.Named("created_at", p.CreatedAt),
+		sql.Named("updated_at", p.UpdatedAt),
+		sql.Named("idempotency_key", p.IdempotencyKey),
+		sql.Named("weight", p.Weight),
+		sql.Named("metadata", metadata),
+		sql.Named("deliver_after", nullString(p.DeliverAfter)),
+		sql.Named("deliver_before", nullString(p.DeliverBefore)),
+	}
+
+	if s.dialect == DialectPostgres {
+		var id int
+		if err := q.QueryRowContext(ctx, query+" RETURNING number", args...).Scan(&id); err != nil {
+			return 0, s.duplicateNumber(p.Number, err)
+		}
+		return id, nil
+	}
+
+	res, err := q.ExecContext(ctx, query, args...)
 	if err != nil {
+		return 0, s.duplicateNumber(p.Number, err)
+	}
+
+	// номер берётся из rowid; в таблице без rowid или с драйвером, не
+	// поддерживающим LastInsertId, вместо номера была бы ошибка или ноль
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrAddFailed, err)
+	}
+	if id <= 0 {
+		return 0, fmt.Errorf("%w: no parcel number returned", ErrAddFailed)
+	}
+	return int(id), nil
+}
+
+// duplicateNumber заменяет ошибку вставки посылки с явно заданным номером
+// на ErrDuplicateNumber, если номер уже занят. Остальные ошибки возвращаются
+// без изменений.
+func (s ParcelStore) duplicateNumber(number int, err error) error {
+	if number <= 0 || !s.isPrimaryKeyViolation(err) {
 		return err
 	}
-	return nil
+	return fmt.Errorf("parcel %d: %w", number, ErrDuplicateNumber)
 }
 
-func (s ParcelStore) Delete(number int) error {
-	_, err := s.db.Exec("DELETE FROM parcel WHERE number = :number AND status = :status",
-		sql.Named("number", number),
-		sql.Named("status", "registered"))
+// isPrimaryKeyViolation сообщает, что запрос нарушил первичный ключ таблицы посылок
+func (s ParcelStore) isPrimaryKeyViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+
+	// 23505 — unique_violation; нарушенное ограничение есть только в тексте ошибки
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		return pgErr.SQLState() == "23505" && strings.Contains(err.Error(), s.table+"_pk")
+	}
+	return false
+}
+
+// conn возвращает querier для запросов вне транзакции хранилища:
+// к базе или к транзакции, заданной через WithTx
+func (s ParcelStore) conn() querier {
+	if s.tx != nil {
+		return s.dialect.wrap(s.tx)
+	}
+	return s.dialect.wrap(s.db)
+}
+
+// InTx выполняет fn в транзакции на базе хранилища: фиксирует её, если fn
+// завершилась без ошибки, и откатывает в противном случае. При временной
+// ошибке («database is locked», конфликт сериализации) транзакция повторяется
+// целиком согласно WithRetry, поэтому fn должна быть готова к повторному
+// вызову и не должна сама фиксировать или откатывать tx. Подходит для
+// операций «прочитать — проверить — записать». В хранилище из WithTx fn
+// выполняется в той транзакции под точкой сохранения и без повторов.
+// Запросы в fn пишутся в синтаксисе драйвера: именованные параметры
+// хранилища в PostgreSQL не переписываются.
+func (s ParcelStore) InTx(ctx context.Context, fn func(tx *sql.Tx) error) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "InTx", start, err) }()
+
+	return s.withRetry(ctx, func() error {
+		return s.runSQLTx(ctx, fn)
+	})
+}
+
+// inTx выполняет fn в транзакции: фиксирует её, если fn завершилась без ошибки,
+// и откатывает в противном случае. При временной ошибке транзакция повторяется
+// целиком согласно политике повторов.
+func (s ParcelStore) inTx(ctx context.Context, fn func(tx querier) error) error {
+	return s.withRetry(ctx, func() error {
+		return s.runTx(ctx, fn)
+	})
+}
+
+func (s ParcelStore) runTx(ctx context.Context, fn func(tx querier) error) error {
+	return s.runSQLTx(ctx, func(tx *sql.Tx) error {
+		return fn(s.dialect.wrap(tx))
+	})
+}
+
+// runSQLTx выполняет fn в новой транзакции или, если задана WithTx, — в ней
+// под точкой сохранения. Транзакция фиксируется, если fn завершилась без ошибки.
+func (s ParcelStore) runSQLTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return s.runSavepoint(ctx, fn)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// runSavepoint выполняет fn внутри транзакции, заданной через WithTx, под
+// точкой сохранения: при ошибке откатываются только изменения fn
+func (s ParcelStore) runSavepoint(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if _, err := s.tx.ExecContext(ctx, "SAVEPOINT parcel_store"); err != nil {
+		return err
+	}
+	if err := fn(s.tx); err != nil {
+		if _, rbErr := s.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT parcel_store"); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+	_, err := s.tx.ExecContext(ctx, "RELEASE SAVEPOINT parcel_store")
+	return err
 }
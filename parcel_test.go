@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,14 +36,34 @@ func getTestParcel() Parcel {
 	}
 }
 
+// newTestDB открывает пустую базу SQLite в памяти, которая закрывается по
+// окончании теста. У каждого подключения к :memory: своя отдельная база,
+// поэтому пул ограничен одним подключением: иначе схема, созданная на одном
+// подключении, не была бы видна на другом. Тестам, которым нужно несколько
+// подключений к одной базе, нужен файл во временном каталоге.
+func newTestDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestStore возвращает хранилище с применённой схемой на новой базе в памяти
+func newTestStore(t testing.TB, opts ...Option) ParcelStore {
+	t.Helper()
+
+	store := NewParcelStore(newTestDB(t), opts...)
+	require.NoError(t, store.Migrate())
+	return store
+}
+
 // TestAddGetDelete проверяет добавление, получение и удаление посылки
 func TestAddGetDelete(t *testing.T) {
 	// prepare
-	db, err := sql.Open("sqlite", "tracker.db")
-	require.NoError(t, err)
-	defer db.Close()
-
-	store := NewParcelStore(db)
+	store := newTestStore(t)
 	parcel := getTestParcel()
 
 	// add
@@ -52,24 +80,170 @@ func TestAddGetDelete(t *testing.T) {
 	require.Equal(t, parcel.Status, got.Status)
 	require.Equal(t, parcel.Address, got.Address)
 	require.Equal(t, parcel.CreatedAt, got.CreatedAt)
+	require.Equal(t, parcel.CreatedAt, got.UpdatedAt)
 
 	// delete
 	err = store.Delete(num)
 	require.NoError(t, err)
 	got, err = store.Get(num)
 	require.Empty(t, got)
-	require.Equal(t, sql.ErrNoRows, err)
+	require.ErrorIs(t, err, ErrParcelNotFound)
 }
 
-// TestSetAddress проверяет обновление адреса
-func TestSetAddress(t *testing.T) {
+// TestDeleteNotAllowed проверяет, что удалить можно только зарегистрированную посылку
+func TestDeleteNotAllowed(t *testing.T) {
 	// prepare
-	db, err := sql.Open("sqlite", "tracker.db")
+	store := newTestStore(t)
+
+	// delete registered
+	num, err := store.Add(getTestParcel())
 	require.NoError(t, err)
-	defer db.Close()
 
-	store := NewParcelStore(db)
+	err = store.Delete(num)
+	require.NoError(t, err)
+	_, err = store.Get(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// delete sent
+	num, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+
+	err = store.Delete(num)
+	require.ErrorIs(t, err, ErrDeleteNotAllowed)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+}
+
+// TestDeleteByClient проверяет удаление посылок одного клиента
+func TestDeleteByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	other := client + 1
+
+	parcels := make([]Parcel, 5)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Client = client
+	}
+	parcels[3].Client = other
+	parcels[4].Client = other
+
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+
+	// отправленная посылка клиента удаляться не должна
+	require.NoError(t, store.SetStatus(numbers[2], ParcelStatusSent))
+
+	// предварительный подсчёт ничего не удаляет и совпадает с результатом удаления
+	deletable, err := store.CountDeletableByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 2, deletable)
+	count, err := store.CountByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// delete by client
+	deleted, err := store.DeleteByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, deletable, deleted)
+
+	// check
+	left, err := store.GetByClient(client)
+	require.NoError(t, err)
+	require.Len(t, left, 1)
+	require.Equal(t, numbers[2], left[0].Number)
+
+	count, err = store.CountByClient(other)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	// удаление каждой посылки записано в историю
+	for _, number := range numbers[:2] {
+		history, err := store.History(number)
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+		require.Equal(t, HistoryEntry{Number: number, Field: HistoryFieldDeleted, OldValue: "false", NewValue: "true",
+			ChangedAt: history[0].ChangedAt}, history[0])
+	}
+}
+
+// TestNotFound проверяет, что операции с несуществующей посылкой возвращают ErrParcelNotFound
+func TestNotFound(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// add & delete, чтобы получить гарантированно свободный номер
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(num))
+
+	// check
+	_, err = store.Get(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	err = store.Delete(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	err = store.SetAddress(num, "new test address")
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	err = store.SetStatus(num, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// остальные изменяющие методы тоже сообщают об отсутствии посылки;
+	// отрицательных номеров автоинкремент не выдаёт
+	missing := -1 - randRange.Intn(10_000_000)
+	ops := map[string]func() error{
+		"SetAddress":          func() error { return store.SetAddress(missing, "new test address") },
+		"SetAddressIfVersion": func() error { return store.SetAddressIfVersion(missing, "new test address", 1) },
+		"SetStatus":           func() error { return store.SetStatus(missing, ParcelStatusSent) },
+		"SetStatusIfVersion":  func() error { return store.SetStatusIfVersion(missing, ParcelStatusSent, 1) },
+		"SetStatusAndAddress": func() error {
+			return store.SetStatusAndAddress(missing, ParcelStatusSent, "new test address")
+		},
+		"Delete":     func() error { return store.Delete(missing) },
+		"SoftDelete": func() error { return store.SoftDelete(missing) },
+		"Duplicate": func() error {
+			_, err := store.Duplicate(missing)
+			return err
+		},
+	}
+	for name, op := range ops {
+		require.ErrorIs(t, op(), ErrParcelNotFound, name)
+	}
+}
+
+// TestAddAndGet проверяет, что AddAndGet возвращает сохранённую посылку
+func TestAddAndGet(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	parcel := getTestParcel()
+
+	// add
+	added, err := store.AddAndGet(parcel)
+	require.NoError(t, err)
+	require.NotEmpty(t, added.Number)
+	require.Equal(t, parcel.Client, added.Client)
+	require.Equal(t, parcel.Address, added.Address)
+
+	// check
+	got, err := store.Get(added.Number)
+	require.NoError(t, err)
+	require.Equal(t, got, added)
+}
+
+// TestSetAddress проверяет обновление адреса
+func TestSetAddress(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
 	parcel := getTestParcel()
+	// посылка создана в прошлом, чтобы было видно, что отметка обновления сдвинулась
+	parcel.CreatedAt = "2020-01-01T00:00:00Z"
 
 	// add
 	num, err := store.Add(parcel)
@@ -85,17 +259,17 @@ func TestSetAddress(t *testing.T) {
 	got, err := store.Get(num)
 	require.NoError(t, err)
 	require.Equal(t, got.Address, newAddress)
+	// RFC3339 в UTC сравнивается как строка
+	require.Greater(t, got.UpdatedAt, parcel.CreatedAt)
 }
 
 // TestSetStatus проверяет обновление статуса
 func TestSetStatus(t *testing.T) {
 	// prepare
-	db, err := sql.Open("sqlite", "tracker.db")
-	require.NoError(t, err)
-	defer db.Close()
-
-	store := NewParcelStore(db)
+	store := newTestStore(t)
 	parcel := getTestParcel()
+	// посылка создана в прошлом, чтобы было видно, что отметка обновления сдвинулась
+	parcel.CreatedAt = "2020-01-01T00:00:00Z"
 
 	// add
 	num, err := store.Add(parcel)
@@ -110,16 +284,192 @@ func TestSetStatus(t *testing.T) {
 	got, err := store.Get(num)
 	require.NoError(t, err)
 	require.Equal(t, got.Status, ParcelStatusSent)
+	// RFC3339 в UTC сравнивается как строка
+	require.Greater(t, got.UpdatedAt, parcel.CreatedAt)
 }
 
-// TestGetByClient проверяет получение посылок по идентификатору клиента
-func TestGetByClient(t *testing.T) {
+// TestSetStatusAndAddress проверяет атомарное изменение статуса и адреса
+func TestSetStatusAndAddress(t *testing.T) {
 	// prepare
-	db, err := sql.Open("sqlite", "tracker.db")
+	store := newTestStore(t)
+	parcel := getTestParcel()
+
+	num, err := store.Add(parcel)
 	require.NoError(t, err)
-	defer db.Close()
 
-	store := NewParcelStore(db)
+	// set status and address
+	err = store.SetStatusAndAddress(num, ParcelStatusSent, "new test address")
+	require.NoError(t, err)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, "new test address", got.Address)
+
+	// недопустимый переход не меняет ни статус, ни адрес
+	err = store.SetStatusAndAddress(num, ParcelStatusRegistered, "another test address")
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, "new test address", got.Address)
+
+	// у отправленной посылки адрес менять нельзя, даже при допустимом переходе статуса
+	err = store.SetStatusAndAddress(num, ParcelStatusDelivered, "another test address")
+	require.ErrorIs(t, err, ErrAddressChangeNotAllowed)
+
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, "new test address", got.Address)
+
+	// тот же адрес не перезаписывается: в истории только смена статуса
+	same, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatusAndAddress(same, ParcelStatusSent, " test "))
+	history, err := store.History(same)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, HistoryFieldStatus, history[0].Field)
+}
+
+// TestStatusTransitions проверяет допустимые и недопустимые переходы статусов
+func TestStatusTransitions(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// legal: registered -> sent -> delivered
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	require.NoError(t, store.SetStatus(num, ParcelStatusDelivered))
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusDelivered, got.Status)
+
+	// illegal: движение назад из delivered
+	for _, status := range []ParcelStatus{ParcelStatusRegistered, ParcelStatusSent, ParcelStatusDelivered} {
+		err = store.SetStatus(num, status)
+		require.ErrorIs(t, err, ErrInvalidStatusTransition)
+	}
+
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusDelivered, got.Status)
+
+	// illegal: пропуск статуса registered -> delivered и неизвестный статус
+	num, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	err = store.SetStatus(num, ParcelStatusDelivered)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+	err = store.SetStatus(num, "unknown")
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+
+	// illegal: движение назад из sent
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	err = store.SetStatus(num, ParcelStatusRegistered)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+
+	// legal: sent -> returned, дальше переходов нет
+	require.NoError(t, store.SetStatus(num, ParcelStatusReturned))
+	err = store.SetStatus(num, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+}
+
+// TestStatusValid проверяет список допустимых статусов
+func TestStatusValid(t *testing.T) {
+	valid := []ParcelStatus{
+		ParcelStatusRegistered,
+		ParcelStatusSent,
+		ParcelStatusDelivered,
+		ParcelStatusReturned,
+		ParcelStatusExpired,
+	}
+	for _, status := range valid {
+		require.True(t, status.Valid(), status)
+	}
+	require.Len(t, parcelStatuses, len(valid))
+
+	for _, status := range []ParcelStatus{"", "registerd", "Sent", "unknown"} {
+		require.False(t, status.Valid(), status)
+	}
+}
+
+// TestIsValidStatus проверяет список допустимых статусов
+func TestIsValidStatus(t *testing.T) {
+	valid := []string{
+		string(ParcelStatusRegistered),
+		string(ParcelStatusSent),
+		string(ParcelStatusDelivered),
+		string(ParcelStatusReturned),
+		string(ParcelStatusExpired),
+	}
+	for _, status := range valid {
+		require.True(t, IsValidStatus(status), status)
+	}
+	require.Len(t, parcelStatuses, len(valid))
+
+	for _, status := range []string{"", "registerd", "Sent", "unknown"} {
+		require.False(t, IsValidStatus(status), status)
+	}
+}
+
+// TestParseStatus проверяет разбор статуса из строки
+func TestParseStatus(t *testing.T) {
+	for _, s := range []string{"registered", "sent", "delivered", "returned"} {
+		status, err := ParseStatus(s)
+		require.NoError(t, err)
+		require.Equal(t, ParcelStatus(s), status)
+	}
+
+	for _, s := range []string{"", "registerd", "Sent", " sent"} {
+		status, err := ParseStatus(s)
+		require.ErrorIs(t, err, ErrUnknownStatus, s)
+		require.Empty(t, status)
+	}
+}
+
+// TestBatchAdd проверяет пакетное добавление посылок
+func TestBatchAdd(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	parcels := make([]Parcel, 100)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Address = fmt.Sprintf("test %d", i)
+	}
+
+	// batch add
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+	require.Len(t, numbers, len(parcels))
+
+	// check
+	unique := map[int]struct{}{}
+	for i, num := range numbers {
+		require.NotEmpty(t, num)
+		unique[num] = struct{}{}
+
+		got, err := store.Get(num)
+		require.NoError(t, err)
+		require.Equal(t, parcels[i].Address, got.Address)
+	}
+	require.Len(t, unique, len(parcels))
+}
+
+// TestGetByClient проверяет получение посылок по идентификатору клиента
+func TestGetByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
 
 	parcels := []Parcel{
 		getTestParcel(),
@@ -129,7 +479,7 @@ func TestGetByClient(t *testing.T) {
 	parcelMap := map[int]Parcel{}
 
 	// задаём всем посылкам один и тот же идентификатор клиента
-	client := randRange.Intn(10_000_000)
+	client := 1 + randRange.Intn(10_000_000)
 	parcels[0].Client = client
 	parcels[1].Client = client
 	parcels[2].Client = client
@@ -142,6 +492,9 @@ func TestGetByClient(t *testing.T) {
 
 		// обновляем идентификатор добавленной у посылки
 		parcels[i].Number = id
+		// при добавлении время обновления совпадает со временем создания
+		parcels[i].UpdatedAt = parcels[i].CreatedAt
+		parcels[i].Version = 1
 
 		// сохраняем добавленную посылку в структуру map, чтобы её можно было легко достать по идентификатору посылки
 		parcelMap[id] = parcels[i]
@@ -158,3 +511,2627 @@ func TestGetByClient(t *testing.T) {
 		require.Equal(t, parcelMap[num], parcel)
 	}
 }
+
+// TestGetByClientPaged проверяет постраничное получение посылок клиента
+func TestGetByClientPaged(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	parcels := make([]Parcel, 5)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Client = client
+	}
+
+	// add
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+
+	// get pages
+	tests := []struct {
+		limit, offset int
+		want          []int
+	}{
+		{limit: 2, offset: 0, want: numbers[0:2]},
+		{limit: 2, offset: 2, want: numbers[2:4]},
+		{limit: 2, offset: 4, want: numbers[4:5]},
+		{limit: 2, offset: 6, want: []int{}},
+		{limit: 10, offset: 0, want: numbers},
+	}
+	for _, tt := range tests {
+		page, err := store.GetByClientPaged(client, tt.limit, tt.offset)
+		require.NoError(t, err)
+
+		got := []int{}
+		for _, parcel := range page {
+			got = append(got, parcel.Number)
+		}
+		require.Equal(t, tt.want, got)
+	}
+
+	// invalid pagination
+	_, err = store.GetByClientPaged(client, 0, 0)
+	require.ErrorIs(t, err, ErrInvalidPagination)
+	_, err = store.GetByClientPaged(client, 1, -1)
+	require.ErrorIs(t, err, ErrInvalidPagination)
+}
+
+// TestCountByClient проверяет подсчёт посылок клиента
+func TestCountByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+
+	// клиент без посылок
+	count, err := store.CountByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	// add
+	parcels := make([]Parcel, 4)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Client = client
+	}
+	_, err = store.BatchAdd(parcels)
+	require.NoError(t, err)
+
+	// check
+	count, err = store.CountByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, len(parcels), count)
+}
+
+// TestGetByStatus проверяет получение посылок по статусу
+func TestGetByStatus(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	parcels := []Parcel{
+		getTestParcel(),
+		getTestParcel(),
+		getTestParcel(),
+	}
+
+	// add
+	for i := 0; i < len(parcels); i++ {
+		id, err := store.Add(parcels[i])
+		require.NoError(t, err)
+		require.NotEmpty(t, id)
+		parcels[i].Number = id
+	}
+
+	// переводим одну посылку в статус «отправлена»
+	err := store.SetStatus(parcels[1].Number, ParcelStatusSent)
+	require.NoError(t, err)
+	parcels[1].Status = ParcelStatusSent
+
+	// get by status
+	sent, err := store.GetByStatus(ParcelStatusSent)
+	require.NoError(t, err)
+
+	// check
+	// в базе могут быть посылки из других тестов, поэтому ищем только добавленные
+	found := map[int]Parcel{}
+	for _, parcel := range sent {
+		require.Equal(t, ParcelStatusSent, parcel.Status)
+		found[parcel.Number] = parcel
+	}
+	// время обновления и отправки выставляет SetStatus, он же увеличивает версию;
+	// остальные поля должны совпасть
+	parcels[1].UpdatedAt = found[parcels[1].Number].UpdatedAt
+	parcels[1].ShippedAt = parcels[1].UpdatedAt
+	parcels[1].Version = 2
+	require.Equal(t, parcels[1], found[parcels[1].Number])
+	require.NotContains(t, found, parcels[0].Number)
+	require.NotContains(t, found, parcels[2].Number)
+
+	// посылки упорядочены по номеру
+	registered, err := store.GetByStatus(ParcelStatusRegistered)
+	require.NoError(t, err)
+	require.Equal(t, []int{parcels[0].Number, parcels[2].Number}, parcelNumbers(registered))
+
+	// пустой результат — пустой срез без ошибки
+	none, err := store.GetByStatus("unknown")
+	require.NoError(t, err)
+	require.NotNil(t, none)
+	require.Empty(t, none)
+}
+
+// TestContextCanceled проверяет, что операции с отменённым контекстом
+// сразу возвращают context.Canceled
+func TestContextCanceled(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	parcel := getTestParcel()
+
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NotEmpty(t, num)
+
+	// отменяем контекст до выполнения запросов
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// check
+	_, err = store.AddContext(ctx, parcel)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetContext(ctx, num)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetByClientContext(ctx, parcel.Client)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetByStatusContext(ctx, parcel.Status)
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = store.SetStatusContext(ctx, num, ParcelStatusSent)
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = store.SetAddressContext(ctx, num, "new test address")
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = store.DeleteContext(ctx, num)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.BatchAddContext(ctx, []Parcel{parcel})
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.AddAndGetContext(ctx, parcel)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.GetByClientPagedContext(ctx, parcel.Client, 10, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.CountByClientContext(ctx, parcel.Client)
+	require.ErrorIs(t, err, context.Canceled)
+
+	err = store.SetStatusAndAddressContext(ctx, num, ParcelStatusSent, "new test address")
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = store.DeleteByClientContext(ctx, parcel.Client)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// посылка осталась без изменений
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, parcel.Status, got.Status)
+	require.Equal(t, parcel.Address, got.Address)
+}
+
+// TestMigrate проверяет создание схемы в пустой базе и повторный вызов Migrate
+func TestMigrate(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+
+	// migrate
+	require.NoError(t, store.Migrate())
+	require.NoError(t, store.Migrate())
+
+	// check
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NotEmpty(t, num)
+
+	_, err = store.Get(num)
+	require.NoError(t, err)
+}
+
+// TestSchemaVersion проверяет учёт версии схемы, в том числе для базы,
+// созданной до появления таблицы миграций
+func TestSchemaVersion(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+
+	version, err := store.SchemaVersion()
+	require.NoError(t, err)
+	require.Zero(t, version)
+
+	// migrate
+	require.NoError(t, store.Migrate())
+	require.NoError(t, store.Migrate())
+
+	// check
+	version, err = store.SchemaVersionContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, LatestSchemaVersion(), version)
+
+	var steps int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM "parcel_schema_migrations"`).Scan(&steps))
+	require.Equal(t, len(parcelMigrations), steps)
+
+	// таблица первой версии схемы без учёта миграций доводится до последней версии
+	_, err = db.Exec(`CREATE TABLE legacy
+(
+    number     integer primary key autoincrement,
+    client     integer      not null,
+    status     VARCHAR(128) not null,
+    address    VARCHAR(512) not null,
+    created_at text         not null
+)`)
+	require.NoError(t, err)
+	legacy := NewParcelStore(db, WithTableName("legacy"))
+	require.NoError(t, legacy.Migrate())
+	version, err = legacy.SchemaVersion()
+	require.NoError(t, err)
+	require.Equal(t, LatestSchemaVersion(), version)
+
+	num, err := legacy.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = legacy.Get(num)
+	require.NoError(t, err)
+}
+
+// TestVerifySchema проверяет сверку колонок таблицы посылок со схемой
+func TestVerifySchema(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	// таблицы ещё нет
+	columns, err := store.Columns()
+	require.NoError(t, err)
+	require.Empty(t, columns)
+	require.ErrorIs(t, store.VerifySchema(), ErrSchemaMissing)
+
+	// migrate
+	require.NoError(t, store.Migrate())
+	columns, err = store.Columns()
+	require.NoError(t, err)
+	require.ElementsMatch(t, expectedColumns(), columns)
+	require.Equal(t, "number", columns[0])
+	require.NoError(t, store.VerifySchema())
+
+	// колонку удалили и добавили лишнюю в обход Migrate
+	_, err = db.Exec(`ALTER TABLE "parcel" DROP COLUMN weight`)
+	require.NoError(t, err)
+	_, err = db.Exec(`ALTER TABLE "parcel" ADD COLUMN color text`)
+	require.NoError(t, err)
+
+	// check
+	err = store.VerifySchema()
+	require.ErrorIs(t, err, ErrSchemaMismatch)
+	require.ErrorContains(t, err, "missing columns [weight]")
+	require.ErrorContains(t, err, "unexpected columns [color]")
+}
+
+// TestParcelJSON проверяет имена полей и нормализацию времени при сериализации в JSON
+func TestParcelJSON(t *testing.T) {
+	parcel := Parcel{
+		Number:    1,
+		Client:    1000,
+		Status:    ParcelStatusRegistered,
+		Address:   "test",
+		CreatedAt: "2024-01-02T06:04:05+03:00",
+		UpdatedAt: "2024-01-02T03:04:05Z",
+		Version:   1,
+	}
+
+	// marshal
+	data, err := json.Marshal(parcel)
+	require.NoError(t, err)
+
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.Len(t, fields, 11)
+	for _, key := range []string{"number", "client", "status", "address", "created_at", "updated_at", "version", "shipped_at", "delivered_at", "weight", "attempts"} {
+		require.Contains(t, fields, key)
+	}
+	require.Equal(t, "2024-01-02T03:04:05Z", fields["created_at"])
+
+	// unmarshal
+	var got Parcel
+	require.NoError(t, json.Unmarshal(data, &got))
+	parcel.CreatedAt = "2024-01-02T03:04:05Z"
+	require.Equal(t, parcel, got)
+
+	// некорректное время
+	parcel.CreatedAt = "yesterday"
+	_, err = json.Marshal(parcel)
+	require.Error(t, err)
+}
+
+// racyQuerier перед первым ExecContext выполняет before — так моделируется
+// конкурентное изменение посылки между чтением и записью
+type racyQuerier struct {
+	querier
+	before func()
+}
+
+func (q *racyQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if q.before != nil {
+		q.before()
+		q.before = nil
+	}
+	return q.querier.ExecContext(ctx, query, args...)
+}
+
+// TestConcurrentStatusChange проверяет, что запись не проходит, если статус
+// сменился после его чтения, даже если версию при этом не увеличили
+func TestConcurrentStatusChange(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+	ctx := context.Background()
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// статус меняется между чтением и UPDATE
+	q := &racyQuerier{querier: db, before: func() {
+		_, err := db.Exec("UPDATE parcel SET status = :status WHERE number = :number",
+			sql.Named("status", ParcelStatusSent), sql.Named("number", num))
+		require.NoError(t, err)
+	}}
+	_, err = store.setStatus(ctx, q, num, ParcelStatusSent, anyVersion)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	// посылка отправлена между чтением и DELETE
+	num, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	q = &racyQuerier{querier: db, before: func() {
+		_, err := db.Exec("UPDATE parcel SET status = :status WHERE number = :number",
+			sql.Named("status", ParcelStatusSent), sql.Named("number", num))
+		require.NoError(t, err)
+	}}
+	err = store.deleteParcel(ctx, q, num)
+	require.ErrorIs(t, err, ErrDeleteNotAllowed)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+}
+
+// TestSearchByAddress проверяет поиск посылок по части адреса
+func TestSearchByAddress(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// уникальная метка, чтобы не зависеть от посылок других тестов
+	tag := fmt.Sprintf("Tag%d", randRange.Intn(10_000_000))
+	addresses := []string{
+		tag + " Main street 1",
+		tag + " main STREET 2",
+		tag + " 100% discount_office",
+		tag + " 100 discount office",
+	}
+	parcels := make([]Parcel, len(addresses))
+	for i, address := range addresses {
+		parcels[i] = getTestParcel()
+		parcels[i].Address = address
+	}
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+
+	search := func(pattern string) []int {
+		found, err := store.SearchByAddress(pattern)
+		require.NoError(t, err)
+		res := []int{}
+		for _, parcel := range found {
+			res = append(res, parcel.Number)
+		}
+		return res
+	}
+
+	// подстрока без учёта регистра, по порядку номеров
+	require.Equal(t, numbers[0:2], search(tag+" MAIN street"))
+	// % и _ ищутся буквально
+	require.Equal(t, numbers[2:3], search(tag+" 100% discount_"))
+	// нет совпадений
+	require.Empty(t, search(tag+" nowhere"))
+
+	// пустой шаблон
+	_, err = store.SearchByAddress("")
+	require.ErrorIs(t, err, ErrEmptyPattern)
+}
+
+// TestGetByDateRange проверяет выборку посылок по времени создания
+func TestGetByDateRange(t *testing.T) {
+	// prepare
+	clock := time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(randRange.Intn(1_000_000)) * time.Hour)
+	start := clock
+	store := newTestStore(t, WithClock(func() time.Time { return clock }))
+	var err error
+
+	client := 1 + randRange.Intn(10_000_000)
+	numbers := make([]int, 4)
+	for i := range numbers {
+		parcel := getTestParcel()
+		parcel.Client = client
+		parcel.CreatedAt = ""
+		numbers[i], err = store.Add(parcel)
+		require.NoError(t, err)
+		clock = clock.Add(time.Hour)
+	}
+
+	inRange := func(from, to time.Time) []int {
+		found, err := store.GetByDateRange(from, to)
+		require.NoError(t, err)
+		res := []int{}
+		for _, parcel := range found {
+			if parcel.Client == client {
+				res = append(res, parcel.Number)
+			}
+		}
+		return res
+	}
+
+	// границы включаются
+	require.Equal(t, numbers[1:3], inRange(start.Add(time.Hour), start.Add(2*time.Hour)))
+	// границы в другом часовом поясе приводятся к UTC
+	msk := time.FixedZone("MSK", 3*60*60)
+	require.Equal(t, numbers[0:2], inRange(start.In(msk), start.Add(time.Hour).In(msk)))
+	// пустое окно
+	require.Empty(t, inRange(start.Add(-2*time.Hour), start.Add(-time.Hour)))
+}
+
+// TestAddNormalizesTimestamps проверяет, что время создания, заданное
+// в другом часовом поясе, хранится в UTC и находится по диапазону дат,
+// а время не в RFC3339 отклоняется
+func TestAddNormalizesTimestamps(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	parcel := getTestParcel()
+	parcel.Client = 1 + randRange.Intn(10_000_000)
+	parcel.CreatedAt = "2024-01-01T10:00:00+03:00"
+
+	// add
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "2024-01-01T07:00:00Z", got.CreatedAt)
+	require.Equal(t, "2024-01-01T07:00:00Z", got.UpdatedAt)
+
+	found, err := store.GetByDateRange(
+		time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, []int{num}, parcelNumbers(found))
+
+	// некорректное время отклоняется в обоих хранилищах
+	for name, s := range map[string]Store{"sqlite": store, "memory": NewMemoryStore()} {
+		bad := getTestParcel()
+		bad.CreatedAt = "not a time"
+		_, err = s.Add(bad)
+		require.ErrorIs(t, err, ErrInvalidParcel, name)
+
+		bad = getTestParcel()
+		bad.UpdatedAt = "yesterday"
+		_, err = s.Add(bad)
+		require.ErrorIs(t, err, ErrInvalidParcel, name)
+	}
+}
+
+// TestVersionConflict проверяет оптимистическую блокировку: изменение по
+// устаревшей версии не проходит
+func TestVersionConflict(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// add
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	stale, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, 1, stale.Version)
+
+	// кто-то другой меняет посылку
+	require.NoError(t, store.SetAddressIfVersion(num, "first address", stale.Version))
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, 2, got.Version)
+
+	// check
+	// изменения по устаревшей версии отклоняются, посылка не меняется
+	err = store.SetAddressIfVersion(num, "stale address", stale.Version)
+	require.ErrorIs(t, err, ErrVersionConflict)
+	err = store.SetStatusIfVersion(num, ParcelStatusSent, stale.Version)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "first address", got.Address)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	require.Equal(t, 2, got.Version)
+
+	// после перечитывания изменение проходит
+	require.NoError(t, store.SetStatusIfVersion(num, ParcelStatusSent, got.Version))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, 3, got.Version)
+
+	// SetStatus и SetAddress без версии тоже увеличивают её
+	num, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetAddress(num, "new address"))
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, 3, got.Version)
+
+	// адрес отправленной посылки не меняется и при актуальной версии
+	err = store.SetAddressIfVersion(num, "late address", got.Version)
+	require.ErrorIs(t, err, ErrAddressChangeNotAllowed)
+
+	// несуществующая посылка
+	err = store.SetAddressIfVersion(-1, "address", 1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestSoftDelete проверяет мягкое удаление и окончательную очистку посылок
+func TestSoftDelete(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewParcelStore(db, WithClock(func() time.Time { return now }))
+	require.NoError(t, store.Migrate())
+
+	parcel := getTestParcel()
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+	kept, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// soft delete
+	require.NoError(t, store.SoftDelete(num))
+
+	// check
+	// посылка пропала из чтения и не меняется
+	_, err = store.Get(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	parcels, err := store.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+	require.Equal(t, kept, parcels[0].Number)
+	require.ErrorIs(t, store.SetStatus(num, ParcelStatusSent), ErrParcelNotFound)
+	require.ErrorIs(t, store.SetAddress(num, "new address"), ErrParcelNotFound)
+	require.ErrorIs(t, store.SoftDelete(num), ErrParcelNotFound)
+	require.ErrorIs(t, store.Delete(num), ErrParcelNotFound)
+
+	// но хранится в базе
+	var deletedAt string
+	require.NoError(t, db.QueryRow("SELECT deleted_at FROM parcel WHERE number = ?", num).Scan(&deletedAt))
+	require.Equal(t, "2030-01-01T00:00:00Z", deletedAt)
+
+	// отправленную посылку удалить нельзя и мягко
+	require.NoError(t, store.SetStatus(kept, ParcelStatusSent))
+	require.ErrorIs(t, store.SoftDelete(kept), ErrDeleteNotAllowed)
+
+	// purge
+	// посылки, удалённые позже границы, остаются
+	purged, err := store.PurgeDeletedBefore(now)
+	require.NoError(t, err)
+	require.Zero(t, purged)
+
+	purged, err = store.PurgeDeletedBefore(now.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, purged)
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM parcel").Scan(&count))
+	require.Equal(t, 1, count)
+
+	// окончательное удаление записано в историю
+	history, err := store.History(num)
+	require.NoError(t, err)
+	last := history[len(history)-1]
+	require.Equal(t, HistoryFieldDeleted, last.Field)
+	require.Equal(t, "true", last.OldValue)
+	require.Equal(t, "purged", last.NewValue)
+}
+
+// TestGetAll проверяет получение всех посылок в порядке номеров
+func TestGetAll(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// пустая таблица
+	all, err := store.GetAll()
+	require.NoError(t, err)
+	require.NotNil(t, all)
+	require.Empty(t, all)
+
+	// add
+	numbers := make([]int, 5)
+	for i := range numbers {
+		parcel := getTestParcel()
+		parcel.Client = 1000 + i%2
+		numbers[i], err = store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	all, err = store.GetAll()
+	require.NoError(t, err)
+	got := make([]int, 0, len(all))
+	for _, parcel := range all {
+		got = append(got, parcel.Number)
+	}
+	require.Equal(t, numbers, got)
+
+	// постранично
+	page, err := store.GetAllPaged(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, all[3:], page)
+
+	_, err = store.GetAllPaged(0, 0)
+	require.ErrorIs(t, err, ErrInvalidPagination)
+}
+
+// TestStatusCounts проверяет подсчёт посылок по статусам
+func TestStatusCounts(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// пустая таблица: все статусы с нулём
+	counts, err := store.StatusCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[ParcelStatus]int{
+		ParcelStatusRegistered: 0,
+		ParcelStatusSent:       0,
+		ParcelStatusDelivered:  0,
+		ParcelStatusReturned:   0,
+		ParcelStatusExpired:    0,
+	}, counts)
+
+	// add
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusDelivered))
+	// мягко удалённые посылки не считаются
+	require.NoError(t, store.SoftDelete(numbers[3]))
+
+	// check
+	counts, err = store.StatusCounts()
+	require.NoError(t, err)
+	require.Equal(t, map[ParcelStatus]int{
+		ParcelStatusRegistered: 1,
+		ParcelStatusSent:       1,
+		ParcelStatusDelivered:  1,
+		ParcelStatusReturned:   0,
+		ParcelStatusExpired:    0,
+	}, counts)
+}
+
+// TestValidate проверяет проверку полей посылки
+func TestValidate(t *testing.T) {
+	require.NoError(t, getTestParcel().Validate())
+
+	tests := map[string]func(p *Parcel){
+		"zero client":      func(p *Parcel) { p.Client = 0 },
+		"negative client":  func(p *Parcel) { p.Client = -1 },
+		"empty address":    func(p *Parcel) { p.Address = "" },
+		"blank address":    func(p *Parcel) { p.Address = " \t\n" },
+		"empty status":     func(p *Parcel) { p.Status = "" },
+		"unknown status":   func(p *Parcel) { p.Status = "registerd" },
+		"uppercase status": func(p *Parcel) { p.Status = "Sent" },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			parcel := getTestParcel()
+			modify(&parcel)
+			require.ErrorIs(t, parcel.Validate(), ErrInvalidParcel)
+		})
+	}
+}
+
+// TestAddInvalid проверяет, что некорректная посылка не добавляется
+func TestAddInvalid(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	parcel := getTestParcel()
+	parcel.Client = client
+	invalid := parcel
+	invalid.Address = ""
+
+	// add
+	_, err := store.Add(invalid)
+	require.ErrorIs(t, err, ErrInvalidParcel)
+	_, err = store.AddAndGet(invalid)
+	require.ErrorIs(t, err, ErrInvalidParcel)
+	// одна некорректная посылка отменяет всю пачку
+	_, err = store.BatchAdd([]Parcel{parcel, invalid})
+	require.ErrorIs(t, err, ErrInvalidParcel)
+
+	// check
+	count, err := store.CountByClient(client)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+// TestPing проверяет проверку доступности базы
+func TestPing(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	ctx := context.Background()
+
+	// check
+	// таблицы ещё нет
+	require.ErrorIs(t, store.Ping(ctx), ErrSchemaMissing)
+
+	require.NoError(t, store.Migrate())
+	require.NoError(t, store.Ping(ctx))
+
+	// база закрыта
+	require.NoError(t, db.Close())
+	err := store.Ping(ctx)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrSchemaMissing)
+}
+
+// TestHistory проверяет запись истории изменений посылки
+func TestHistory(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewParcelStore(db, WithClock(func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}))
+	require.NoError(t, store.Migrate())
+
+	parcel := getTestParcel()
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	history, err := store.History(num)
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	// change
+	require.NoError(t, store.SetAddress(num, "new address"))
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	// неудачные изменения в историю не попадают
+	require.Error(t, store.SetStatus(num, ParcelStatusRegistered))
+	require.NoError(t, store.SetAddress(num, "ignored address"))
+
+	// check
+	history, err = store.History(num)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, HistoryEntry{num, HistoryFieldAddress, parcel.Address, "new address", "2030-01-01T00:02:00Z"}, history[0])
+	require.Equal(t, HistoryEntry{num, HistoryFieldStatus, "registered", "sent", "2030-01-01T00:04:00Z"}, history[1])
+
+	// история остаётся после удаления посылки
+	num, err = store.Add(parcel)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatusAndAddress(num, ParcelStatusSent, "other address"))
+	num2, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(num2))
+
+	history, err = store.History(num)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, HistoryFieldStatus, history[0].Field)
+	require.Equal(t, HistoryFieldAddress, history[1].Field)
+	require.Equal(t, "other address", history[1].NewValue)
+
+	history, err = store.History(num2)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, HistoryFieldDeleted, history[0].Field)
+	require.Equal(t, "true", history[0].NewValue)
+}
+
+// TestDuplicate проверяет создание копии посылки для повторной отправки
+func TestDuplicate(t *testing.T) {
+	// prepare
+	fixed := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return fixed }))
+
+	parcel := getTestParcel()
+	parcel.Address = "Псков, д. Пушкина, ул. Колотушкина, д. 5"
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	require.NoError(t, store.SetStatus(num, ParcelStatusDelivered))
+
+	// duplicate
+	copyNum, err := store.Duplicate(num)
+	require.NoError(t, err)
+
+	// check
+	require.NotEqual(t, num, copyNum)
+	got, err := store.Get(copyNum)
+	require.NoError(t, err)
+	require.Equal(t, Parcel{
+		Number:    copyNum,
+		Client:    parcel.Client,
+		Status:    ParcelStatusRegistered,
+		Address:   parcel.Address,
+		CreatedAt: "2030-01-02T03:04:05Z",
+		UpdatedAt: "2030-01-02T03:04:05Z",
+		Version:   1,
+	}, got)
+
+	// исходная посылка не меняется
+	src, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusDelivered, src.Status)
+
+	// несуществующая посылка
+	_, err = store.Duplicate(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestWithTx проверяет работу хранилища внутри транзакции вызывающего
+func TestWithTx(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	// откат транзакции отменяет добавление
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	num, err := store.WithTx(tx).Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.WithTx(tx).Get(num)
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	_, err = store.Get(num)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// фиксация вместе с собственным запросом вызывающего
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("CREATE TABLE ledger (number integer not null)")
+	require.NoError(t, err)
+	num, err = store.WithTx(tx).Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = tx.Exec("INSERT INTO ledger (number) VALUES (?)", num)
+	require.NoError(t, err)
+
+	// ошибка метода с собственной транзакцией откатывает только его изменения
+	invalid := getTestParcel()
+	invalid.Address = ""
+	_, err = store.WithTx(tx).BatchAdd([]Parcel{getTestParcel(), invalid})
+	require.ErrorIs(t, err, ErrInvalidParcel)
+	require.NoError(t, store.WithTx(tx).SetStatus(num, ParcelStatusSent))
+	require.NoError(t, tx.Commit())
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	var ledger int
+	require.NoError(t, db.QueryRow("SELECT number FROM ledger").Scan(&ledger))
+	require.Equal(t, num, ledger)
+	all, err := store.GetAll()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+}
+
+// TestGetMany проверяет получение нескольких посылок по номерам
+func TestGetMany(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+
+	// get many
+	got, err := store.GetMany([]int{numbers[0], -1, numbers[2], numbers[0]})
+	require.NoError(t, err)
+
+	// check
+	// несуществующие номера просто отсутствуют, повторы не мешают
+	require.Len(t, got, 2)
+	for _, num := range []int{numbers[0], numbers[2]} {
+		parcel, err := store.Get(num)
+		require.NoError(t, err)
+		require.Equal(t, parcel, got[num])
+	}
+	require.NotContains(t, got, numbers[1])
+
+	// пустой список
+	got, err = store.GetMany(nil)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Empty(t, got)
+}
+
+// TestGetManyOrdered проверяет, что результат GetManyOrdered выровнен по входным номерам
+func TestGetManyOrdered(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+
+	// get many ordered
+	got, err := store.GetManyOrdered([]int{-1, numbers[1], -2, numbers[0], numbers[1]})
+	require.NoError(t, err)
+
+	// check
+	require.Len(t, got, 5)
+	for _, i := range []int{0, 2} {
+		require.Nil(t, got[i])
+	}
+	for i, num := range map[int]int{1: numbers[1], 3: numbers[0], 4: numbers[1]} {
+		parcel, err := store.Get(num)
+		require.NoError(t, err)
+		require.NotNil(t, got[i])
+		require.Equal(t, parcel, *got[i])
+	}
+	// повторяющиеся номера не делят одну посылку
+	require.NotSame(t, got[1], got[4])
+
+	// пустой список
+	got, err = store.GetManyOrdered(nil)
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Empty(t, got)
+}
+
+// TestNormalizeAddress проверяет нормализацию адреса
+func TestNormalizeAddress(t *testing.T) {
+	tests := map[string]string{
+		"Псков, ул. Колотушкина, д. 5":           "Псков, ул. Колотушкина, д. 5",
+		"  Псков,   ул. Колотушкина  ":           "Псков, ул. Колотушкина",
+		"Псков,\tул.\nКолотушкина\r\n":           "Псков, ул. Колотушкина",
+		"Псков,\u00a0ул.\u00a0\u00a0Колотушкина": "Псков, ул. Колотушкина",
+		"Пско\x00в, ул.\x1b Колотушкина\x7f":     "Псков, ул. Колотушкина",
+		"ПСКОВ, Ул. Колотушкина":                 "ПСКОВ, Ул. Колотушкина",
+		" \t\n ": "",
+	}
+	for in, want := range tests {
+		require.Equal(t, want, NormalizeAddress(in), "%q", in)
+	}
+}
+
+// TestAddressNormalizedOnStore проверяет, что адрес сохраняется нормализованным
+func TestAddressNormalizedOnStore(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	parcel := getTestParcel()
+	parcel.Address = "  Псков,\t ул.  Колотушкина\n"
+
+	// add
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "Псков, ул. Колотушкина", got.Address)
+
+	// set address
+	require.NoError(t, store.SetAddress(num, " Саратов,\r\n ул.   Козлова "))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "Саратов, ул. Козлова", got.Address)
+
+	// адрес только из пробелов после нормализации пуст и не принимается
+	parcel.Address = " \t "
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrInvalidParcel)
+}
+
+// TestGetByClientAndStatus проверяет выборку посылок клиента по статусу
+func TestGetByClientAndStatus(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	parcels := make([]Parcel, 4)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Client = client
+	}
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[2], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[2], ParcelStatusDelivered))
+	require.NoError(t, store.SetStatus(numbers[3], ParcelStatusSent))
+
+	// посылка другого клиента в том же статусе
+	other := getTestParcel()
+	other.Client = client + 1
+	otherNum, err := store.Add(other)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(otherNum, ParcelStatusSent))
+
+	numbersOf := func(parcels []Parcel) []int {
+		res := []int{}
+		for _, p := range parcels {
+			res = append(res, p.Number)
+		}
+		return res
+	}
+
+	// check
+	sent, err := store.GetByClientAndStatus(client, ParcelStatusSent)
+	require.NoError(t, err)
+	require.Equal(t, []int{numbers[0], numbers[3]}, numbersOf(sent))
+
+	registered, err := store.GetByClientAndStatus(client, ParcelStatusRegistered)
+	require.NoError(t, err)
+	require.Equal(t, []int{numbers[1]}, numbersOf(registered))
+
+	returned, err := store.GetByClientAndStatus(client, ParcelStatusReturned)
+	require.NoError(t, err)
+	require.NotNil(t, returned)
+	require.Empty(t, returned)
+}
+
+// TestSetStatusMany проверяет смену статуса нескольких посылок одним вызовом
+func TestSetStatusMany(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	var changes []int
+	store := NewParcelStore(db, WithOnStatusChange(func(number int, old, new ParcelStatus) {
+		changes = append(changes, number)
+	}))
+	require.NoError(t, store.Migrate())
+
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+
+	// set status
+	n, err := store.SetStatusMany(append(numbers, numbers[0]), ParcelStatusSent)
+	require.NoError(t, err)
+
+	// check
+	require.Equal(t, 3, n)
+	require.Equal(t, numbers, changes)
+	for _, num := range numbers {
+		got, err := store.Get(num)
+		require.NoError(t, err)
+		require.Equal(t, ParcelStatusSent, got.Status)
+		require.Equal(t, 2, got.Version)
+
+		history, err := store.History(num)
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+	}
+
+	// одна недопустимая посылка отменяет всю пачку
+	registered, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.SetStatusMany([]int{registered, numbers[0]}, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+	require.ErrorContains(t, err, fmt.Sprintf("parcel %d", numbers[0]))
+	_, err = store.SetStatusMany([]int{registered, -1}, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	got, err := store.Get(registered)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+
+	// пустой список
+	n, err = store.SetStatusMany(nil, ParcelStatusSent)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+// TestVacuum проверяет обслуживание базы после массового удаления
+func TestVacuum(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	parcels := make([]Parcel, 2000)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Address = strings.Repeat("адрес ", 50)
+	}
+	_, err = store.BatchAdd(parcels)
+	require.NoError(t, err)
+	_, err = store.DeleteByClient(getTestParcel().Client)
+	require.NoError(t, err)
+
+	pages := func() int {
+		var n int
+		require.NoError(t, db.QueryRow("PRAGMA page_count").Scan(&n))
+		return n
+	}
+	before := pages()
+
+	// vacuum
+	require.NoError(t, store.Vacuum(context.Background()))
+
+	// check
+	require.Less(t, pages(), before)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, store.Vacuum(ctx), context.Canceled)
+}
+
+// TestShip проверяет отправку посылки
+func TestShip(t *testing.T) {
+	// prepare
+	fixed := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return fixed }))
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Empty(t, got.ShippedAt)
+
+	// ship
+	require.NoError(t, store.Ship(num))
+
+	// check
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, "2030-01-02T03:04:05Z", got.ShippedAt)
+
+	// повторная отправка и отправка доставленной посылки недопустимы
+	require.ErrorIs(t, store.Ship(num), ErrInvalidStatusTransition)
+	require.NoError(t, store.SetStatus(num, ParcelStatusDelivered))
+	require.ErrorIs(t, store.Ship(num), ErrInvalidStatusTransition)
+	require.ErrorIs(t, store.Ship(-1), ErrParcelNotFound)
+
+	// время отправки при доставке не меняется
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "2030-01-02T03:04:05Z", got.ShippedAt)
+}
+
+// TestDeliver проверяет доставку посылки
+func TestDeliver(t *testing.T) {
+	// prepare
+	fixed := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return fixed }))
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// зарегистрированную посылку нельзя сразу доставить, и она не меняется
+	require.ErrorIs(t, store.Deliver(num), ErrInvalidStatusTransition)
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	require.Empty(t, got.DeliveredAt)
+	require.Equal(t, 1, got.Version)
+
+	// deliver
+	require.NoError(t, store.Ship(num))
+	require.NoError(t, store.Deliver(num))
+
+	// check
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusDelivered, got.Status)
+	require.Equal(t, "2030-01-02T03:04:05Z", got.DeliveredAt)
+
+	require.ErrorIs(t, store.Deliver(num), ErrInvalidStatusTransition)
+	require.ErrorIs(t, store.Deliver(-1), ErrParcelNotFound)
+}
+
+// TestIterate проверяет обход всех посылок и его досрочное прекращение
+func TestIterate(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	var err error
+
+	numbers := make([]int, 5)
+	for i := range numbers {
+		numbers[i], err = store.Add(getTestParcel())
+		require.NoError(t, err)
+	}
+	// удалённые посылки не обходятся
+	deleted, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SoftDelete(deleted))
+
+	// iterate
+	var got []int
+	err = store.Iterate(context.Background(), func(p Parcel) error {
+		got = append(got, p.Number)
+		return nil
+	})
+
+	// check
+	require.NoError(t, err)
+	require.Equal(t, numbers, got)
+
+	// ошибка из fn прекращает обход и возвращается как есть
+	errStop := errors.New("stop")
+	calls := 0
+	err = store.Iterate(context.Background(), func(p Parcel) error {
+		calls++
+		if calls == 2 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.Equal(t, 2, calls)
+}
+
+// TestAddFailed проверяет, что Add возвращает ErrAddFailed, а не нулевой номер,
+// если номер новой посылки получить нельзя
+func TestAddFailed(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	// в таблице без rowid LastInsertId не возвращает номер вставленной строки
+	_, err := db.Exec(`CREATE TABLE parcel
+(
+    number     integer      not null default 0 primary key,
+    client     integer      not null,
+    status     VARCHAR(128) not null,
+    address    VARCHAR(512) not null,
+    created_at text         not null,
+    updated_at text         not null,
+    version    integer      not null,
+    idempotency_key text    not null default '',
+    weight     real         not null default 0,
+    metadata   text         not null default '{}',
+    attempts   integer      not null default 0,
+    deliver_after  text,
+    deliver_before text
+) WITHOUT ROWID`)
+	require.NoError(t, err)
+
+	store := NewParcelStore(db)
+
+	// add
+	num, err := store.Add(getTestParcel())
+
+	// check
+	require.ErrorIs(t, err, ErrAddFailed)
+	require.Zero(t, num)
+}
+
+// TestConcurrentUse проверяет конкурентную работу с хранилищем из многих горутин:
+// ни одна запись не должна потеряться. Гонки данных выявляет go test -race.
+func TestConcurrentUse(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db, WithRetry(20, 5*time.Millisecond))
+	require.NoError(t, store.Migrate())
+
+	const (
+		workers = 8
+		perWork = 20
+	)
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func(client int) {
+			errs <- func() error {
+				for i := 0; i < perWork; i++ {
+					parcel := getTestParcel()
+					parcel.Client = client
+					num, err := store.Add(parcel)
+					if err != nil {
+						return err
+					}
+					if _, err := store.Get(num); err != nil {
+						return err
+					}
+					if err := store.SetStatus(num, ParcelStatusSent); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}(w + 1)
+	}
+	for w := 0; w < workers; w++ {
+		require.NoError(t, <-errs)
+	}
+
+	// check
+	for client := 1; client <= workers; client++ {
+		parcels, err := store.GetByClient(client)
+		require.NoError(t, err)
+		require.Len(t, parcels, perWork)
+		for _, parcel := range parcels {
+			require.Equal(t, ParcelStatusSent, parcel.Status)
+			require.Equal(t, 2, parcel.Version)
+		}
+	}
+}
+
+// TestSetSameAddress проверяет, что повторная установка того же адреса
+// не перезаписывает посылку
+func TestSetSameAddress(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewParcelStore(db, WithClock(func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}))
+	require.NoError(t, store.Migrate())
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// set address
+	require.NoError(t, store.SetAddress(num, "new address"))
+	first, err := store.Get(num)
+	require.NoError(t, err)
+	// адрес совпадает с текущим после нормализации
+	require.NoError(t, store.SetAddress(num, " new   address "))
+	require.NoError(t, store.SetAddressIfVersion(num, "new address", first.Version))
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+
+	history, err := store.History(num)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "new address", history[0].NewValue)
+}
+
+// TestGetByClientSorted проверяет сортировку посылок клиента
+func TestGetByClientSorted(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	var err error
+
+	client := 1 + randRange.Intn(10_000_000)
+	// посылки добавляются не в порядке создания
+	created := []string{"2024-01-03T00:00:00Z", "2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"}
+	numbers := make([]int, len(created))
+	for i, ts := range created {
+		parcel := getTestParcel()
+		parcel.Client = client
+		parcel.CreatedAt = ts
+		numbers[i], err = store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	asc, err := store.GetByClientSorted(client, "created_at", false)
+	require.NoError(t, err)
+	require.Equal(t, []int{numbers[1], numbers[2], numbers[0]}, parcelNumbers(asc))
+
+	desc, err := store.GetByClientSorted(client, "created_at", true)
+	require.NoError(t, err)
+	require.Equal(t, []int{numbers[0], numbers[2], numbers[1]}, parcelNumbers(desc))
+
+	// GetByClient упорядочивает по номеру
+	byNumber, err := store.GetByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, numbers, parcelNumbers(byNumber))
+
+	for _, column := range []string{"address", "number; DROP TABLE parcel", ""} {
+		_, err = store.GetByClientSorted(client, column, false)
+		require.ErrorIs(t, err, ErrInvalidOrder)
+	}
+}
+
+// parcelNumbers возвращает номера посылок в том же порядке
+func parcelNumbers(parcels []Parcel) []int {
+	res := make([]int, 0, len(parcels))
+	for _, p := range parcels {
+		res = append(res, p.Number)
+	}
+	return res
+}
+
+// TestDeleteOlderThan проверяет удаление посылок, созданных раньше заданного времени
+func TestDeleteOlderThan(t *testing.T) {
+	// prepare
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return now }))
+
+	add := func(created time.Time) int {
+		now = created
+		parcel := getTestParcel()
+		parcel.CreatedAt = ""
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		return num
+	}
+	old := add(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	oldSent := add(time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, store.SetStatus(oldSent, ParcelStatusSent))
+	fresh := add(time.Date(2030, 1, 10, 0, 0, 0, 0, time.UTC))
+
+	// delete
+	// граница в другом часовом поясе: 2030-01-05T00:00:00Z
+	before := time.Date(2030, 1, 5, 3, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	deletable, err := store.CountOlderThan(context.Background(), before)
+	require.NoError(t, err)
+	deleted, err := store.DeleteOlderThan(context.Background(), before)
+
+	// check
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, deletable, deleted)
+	_, err = store.Get(old)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	history, err := store.History(old)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, HistoryFieldDeleted, history[0].Field)
+	// отправленная посылка не удаляется, как и в Delete
+	_, err = store.Get(oldSent)
+	require.NoError(t, err)
+	_, err = store.Get(fresh)
+	require.NoError(t, err)
+
+	// отменённый контекст
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.DeleteOlderThan(ctx, now)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// TestNewParcelStoreChecked проверяет ошибки конструктора вместо паники
+func TestNewParcelStoreChecked(t *testing.T) {
+	// nil вместо базы
+	_, err := NewParcelStoreChecked(nil)
+	require.ErrorIs(t, err, ErrNilDB)
+	require.PanicsWithValue(t, "parcel store: nil database", func() { NewParcelStore(nil) })
+
+	db := newTestDB(t)
+
+	_, err = NewParcelStoreChecked(db, WithTableName("bad name"))
+	require.Error(t, err)
+
+	store, err := NewParcelStoreChecked(db)
+	require.NoError(t, err)
+	require.NoError(t, store.Migrate())
+	_, err = store.Get(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestSetClient проверяет перевод посылки другому клиенту
+func TestSetClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	clientA := 1 + randRange.Intn(10_000_000)
+	clientB := clientA + 1
+	parcel := getTestParcel()
+	parcel.Client = clientA
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// set client
+	require.NoError(t, store.SetClient(num, clientB))
+
+	// check
+	byA, err := store.GetByClient(clientA)
+	require.NoError(t, err)
+	require.NotContains(t, parcelNumbers(byA), num)
+	byB, err := store.GetByClient(clientB)
+	require.NoError(t, err)
+	require.Contains(t, parcelNumbers(byB), num)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, clientB, got.Client)
+	require.Equal(t, 2, got.Version)
+
+	history, err := store.History(num)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, HistoryFieldClient, history[0].Field)
+	require.Equal(t, strconv.Itoa(clientA), history[0].OldValue)
+	require.Equal(t, strconv.Itoa(clientB), history[0].NewValue)
+
+	require.ErrorIs(t, store.SetClient(num, 0), ErrInvalidParcel)
+	require.ErrorIs(t, store.SetClient(-1, clientB), ErrParcelNotFound)
+}
+
+// TestGetLatestByClient проверяет получение самой новой посылки клиента
+func TestGetLatestByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	_, err := store.GetLatestByClient(client)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// самая новая посылка добавляется не последней; две последние созданы одновременно
+	created := []string{"2024-01-01T00:00:00Z", "2024-01-03T00:00:00Z", "2024-01-03T00:00:00Z", "2024-01-02T00:00:00Z"}
+	numbers := make([]int, len(created))
+	for i, ts := range created {
+		parcel := getTestParcel()
+		parcel.Client = client
+		parcel.CreatedAt = ts
+		numbers[i], err = store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	latest, err := store.GetLatestByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, numbers[2], latest.Number)
+	require.Equal(t, "2024-01-03T00:00:00Z", latest.CreatedAt)
+}
+
+// TestAddIdempotent проверяет, что повторный Add с тем же ключом идемпотентности
+// не создаёт новую посылку
+func TestAddIdempotent(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	parcel := getTestParcel()
+	parcel.Client = client
+	parcel.IdempotencyKey = "import-42"
+
+	// add
+	first, err := store.Add(parcel)
+	require.NoError(t, err)
+	second, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	require.Equal(t, first, second)
+	count, err := store.CountByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	got, err := store.Get(first)
+	require.NoError(t, err)
+	require.Equal(t, "import-42", got.IdempotencyKey)
+
+	// ключи у каждого клиента свои, а без ключа посылки добавляются как обычно
+	other := parcel
+	other.Client = client + 1
+	third, err := store.Add(other)
+	require.NoError(t, err)
+	require.NotEqual(t, first, third)
+
+	parcel.IdempotencyKey = ""
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+	count, err = store.CountByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+
+	// после удаления ключ снова свободен
+	require.NoError(t, store.SoftDelete(first))
+	parcel.IdempotencyKey = "import-42"
+	fourth, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NotEqual(t, first, fourth)
+}
+
+// TestAllGroupedByClient проверяет группировку всех посылок по клиентам
+func TestAllGroupedByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// пустая таблица
+	groups, err := store.AllGroupedByClient()
+	require.NoError(t, err)
+	require.NotNil(t, groups)
+	require.Empty(t, groups)
+
+	// add
+	clients := []int{1000, 2000, 1000, 2000, 1000}
+	want := map[int][]int{}
+	for _, client := range clients {
+		parcel := getTestParcel()
+		parcel.Client = client
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		want[client] = append(want[client], num)
+	}
+
+	// check
+	groups, err = store.AllGroupedByClient()
+	require.NoError(t, err)
+	require.Len(t, groups, len(want))
+	for client, numbers := range want {
+		require.Equal(t, numbers, parcelNumbers(groups[client]))
+		for _, parcel := range groups[client] {
+			require.Equal(t, client, parcel.Client)
+		}
+	}
+}
+
+// TestAddDuplicateNumber проверяет добавление посылки с явно заданным номером
+func TestAddDuplicateNumber(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	parcel := getTestParcel()
+	parcel.Number = 100
+
+	// add
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.Equal(t, 100, num)
+
+	// check
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrDuplicateNumber)
+
+	// ошибки, не связанные с номером, не подменяются
+	_, err = store.Add(Parcel{Number: 100, Status: ParcelStatusRegistered, Address: "test"})
+	require.ErrorIs(t, err, ErrInvalidParcel)
+	require.NotErrorIs(t, err, ErrDuplicateNumber)
+}
+
+// TestExpireStale проверяет перевод давно не отправленных посылок в статус expired
+func TestExpireStale(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	now := time.Date(2030, 1, 10, 12, 0, 0, 0, time.UTC)
+	var changes []ParcelStatus
+	store := NewParcelStore(db,
+		WithClock(func() time.Time { return now }),
+		WithOnStatusChange(func(number int, old, new ParcelStatus) { changes = append(changes, new) }))
+	require.NoError(t, store.Migrate())
+
+	add := func(created time.Time) int {
+		parcel := getTestParcel()
+		parcel.CreatedAt = formatTime(created)
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		return num
+	}
+	stale := add(now.Add(-48 * time.Hour))
+	fresh := add(now.Add(-time.Hour))
+	// отправленная посылка не истекает, сколько бы ей ни было
+	sent := add(now.Add(-72 * time.Hour))
+	require.NoError(t, store.SetStatus(sent, ParcelStatusSent))
+	changes = nil
+
+	// expire
+	expired, err := store.ExpireStale(24 * time.Hour)
+
+	// check
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	require.Equal(t, []ParcelStatus{ParcelStatusExpired}, changes)
+
+	got, err := store.Get(stale)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusExpired, got.Status)
+	require.Equal(t, 2, got.Version)
+	history, err := store.History(stale)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "expired", history[0].NewValue)
+
+	got, err = store.Get(fresh)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	got, err = store.Get(sent)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+
+	// истёкшую посылку нельзя отправить
+	require.ErrorIs(t, store.SetStatus(stale, ParcelStatusSent), ErrInvalidStatusTransition)
+
+	// повторный вызов ничего не меняет
+	expired, err = store.ExpireStale(24 * time.Hour)
+	require.NoError(t, err)
+	require.Zero(t, expired)
+}
+
+// TestGetWithHistory проверяет получение посылки вместе с историей
+func TestGetWithHistory(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetAddress(num, "new address"))
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+
+	// get
+	parcel, history, err := store.GetWithHistory(num)
+
+	// check
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, parcel.Status)
+	require.Equal(t, "new address", parcel.Address)
+	require.Equal(t, 3, parcel.Version)
+	require.Len(t, history, 2)
+	require.Equal(t, HistoryFieldAddress, history[0].Field)
+	require.Equal(t, HistoryFieldStatus, history[1].Field)
+
+	// хранилище только для чтения тоже может читать
+	parcel, history, err = NewParcelStore(db, WithReadOnly()).GetWithHistory(num)
+	require.NoError(t, err)
+	require.Equal(t, num, parcel.Number)
+	require.Len(t, history, 2)
+
+	_, _, err = store.GetWithHistory(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestDistinctClients проверяет получение списка клиентов с посылками
+func TestDistinctClients(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// пустая таблица
+	clients, err := store.DistinctClients()
+	require.NoError(t, err)
+	require.NotNil(t, clients)
+	require.Empty(t, clients)
+
+	// add
+	for _, client := range []int{3000, 1000, 3000, 2000, 1000} {
+		parcel := getTestParcel()
+		parcel.Client = client
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	clients, err = store.DistinctClients()
+	require.NoError(t, err)
+	require.Equal(t, []int{1000, 2000, 3000}, clients)
+}
+
+// TestGetByNumberPrefix проверяет поиск посылок по началу номера
+func TestGetByNumberPrefix(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	for _, number := range []int{12, 123, 1234, 21, 312} {
+		parcel := getTestParcel()
+		parcel.Number = number
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	found, err := store.GetByNumberPrefix(12)
+	require.NoError(t, err)
+	require.Equal(t, []int{12, 123, 1234}, parcelNumbers(found))
+
+	found, err = store.GetByNumberPrefix(2)
+	require.NoError(t, err)
+	require.Equal(t, []int{21}, parcelNumbers(found))
+
+	found, err = store.GetByNumberPrefix(9)
+	require.NoError(t, err)
+	require.Empty(t, found)
+
+	found, err = store.GetByNumberPrefix(0)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	require.Empty(t, found)
+
+	// результат ограничен numberPrefixLimit
+	parcels := make([]Parcel, numberPrefixLimit+1)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Number = 5000 + i
+	}
+	_, err = store.BatchAdd(parcels)
+	require.NoError(t, err)
+	found, err = store.GetByNumberPrefix(5)
+	require.NoError(t, err)
+	require.Len(t, found, numberPrefixLimit)
+	require.Equal(t, 5000, found[0].Number)
+}
+
+// TestTransitionBatch проверяет пакетную смену статуса с отказами
+// для отдельных посылок
+func TestTransitionBatch(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	var (
+		changed []int
+		batches []TransitionResult
+	)
+	store := NewParcelStore(db,
+		WithOnStatusChange(func(number int, old, new ParcelStatus) {
+			changed = append(changed, number)
+		}),
+		WithOnBatchTransition(func(res TransitionResult) {
+			batches = append(batches, res)
+		}))
+	require.NoError(t, store.Migrate())
+
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+	// вторую посылку уже нельзя перевести из registered в sent
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusSent))
+	changed = nil
+
+	// transition
+	res, err := store.TransitionBatch([]int{numbers[0], numbers[1], -1, numbers[2], numbers[0]}, ParcelStatusSent)
+
+	// check
+	require.NoError(t, err)
+	require.Equal(t, []int{numbers[0], numbers[2]}, res.Succeeded)
+	require.Len(t, res.Rejected, 2)
+	require.ErrorIs(t, res.Rejected[numbers[1]], ErrInvalidStatusTransition)
+	require.ErrorIs(t, res.Rejected[-1], ErrParcelNotFound)
+	require.Equal(t, res.Succeeded, changed)
+	// обработчик пачки вызван один раз с тем же итогом
+	require.Len(t, batches, 1)
+	require.Equal(t, res, batches[0])
+
+	for _, number := range res.Succeeded {
+		got, err := store.Get(number)
+		require.NoError(t, err)
+		require.Equal(t, ParcelStatusSent, got.Status)
+
+		history, err := store.History(number)
+		require.NoError(t, err)
+		require.Len(t, history, 1)
+	}
+	// отклонённая посылка не изменилась
+	got, err := store.Get(numbers[1])
+	require.NoError(t, err)
+	require.Equal(t, 2, got.Version)
+}
+
+// TestWeight проверяет хранение веса посылок и суммарный вес по клиенту
+func TestWeight(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	total, err := store.TotalWeightByClient(client)
+	require.NoError(t, err)
+	require.Zero(t, total)
+
+	// add
+	weights := []float64{250, 1000.5, 0}
+	numbers := make([]int, len(weights))
+	for i, weight := range weights {
+		parcel := getTestParcel()
+		parcel.Client = client
+		parcel.Weight = weight
+		numbers[i], err = store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	for i, number := range numbers {
+		got, err := store.Get(number)
+		require.NoError(t, err)
+		require.Equal(t, weights[i], got.Weight)
+	}
+	byClient, err := store.GetByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 1000.5, byClient[1].Weight)
+
+	total, err = store.TotalWeightByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, 1250.5, total)
+
+	parcel := getTestParcel()
+	parcel.Weight = -1
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrInvalidParcel)
+}
+
+// TestStatusCountsByClient проверяет подсчёт посылок клиента по статусам
+func TestStatusCountsByClient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	client := 1 + randRange.Intn(10_000_000)
+	counts, err := store.StatusCountsByClient(client)
+	require.NoError(t, err)
+	require.NotNil(t, counts)
+	require.Empty(t, counts)
+
+	// add
+	parcels := make([]Parcel, 4)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+		parcels[i].Client = client
+	}
+	numbers, err := store.BatchAdd(parcels)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusDelivered))
+
+	// посылки другого клиента не учитываются
+	other := getTestParcel()
+	other.Client = client + 1
+	_, err = store.Add(other)
+	require.NoError(t, err)
+
+	// check
+	counts, err = store.StatusCountsByClient(client)
+	require.NoError(t, err)
+	require.Equal(t, map[ParcelStatus]int{
+		ParcelStatusRegistered: 2,
+		ParcelStatusSent:       1,
+		ParcelStatusDelivered:  1,
+	}, counts)
+}
+
+// TestExists проверяет проверку существования посылки
+func TestExists(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// add
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// check
+	exists, err := store.Exists(num)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	exists, err = store.Exists(-1 - randRange.Intn(10_000_000))
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	// удалённая посылка не существует
+	require.NoError(t, store.Delete(num))
+	exists, err = store.Exists(num)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+// TestGetStatus проверяет чтение только статуса посылки
+func TestGetStatus(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// add
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// check
+	status, err := store.GetStatus(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, status)
+
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	status, err = store.GetStatus(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, status)
+
+	_, err = store.GetStatus(-1 - randRange.Intn(10_000_000))
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestFindIncompleteAddresses проверяет поиск посылок с пустым адресом или адресом-заглушкой
+func TestFindIncompleteAddresses(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db, WithPlaceholderAddresses("test", " N/A "))
+	require.NoError(t, store.Migrate())
+
+	// все адреса заполнены
+	incomplete, err := store.FindIncompleteAddresses()
+	require.NoError(t, err)
+	require.NotNil(t, incomplete)
+	require.Empty(t, incomplete)
+
+	// add
+	var want []int
+	for _, address := range []string{"Moscow, Lenina 1", "test", "Testing street", "TEST", "n/a"} {
+		parcel := getTestParcel()
+		parcel.Address = address
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		if address != "Moscow, Lenina 1" && address != "Testing street" {
+			want = append(want, num)
+		}
+	}
+	// пустые адреса Add не принимает, поэтому они вставляются напрямую
+	for _, address := range []string{"", "   "} {
+		res, err := db.Exec(`INSERT INTO "parcel" (client, status, address, created_at) VALUES (1000, 'registered', ?, '')`, address)
+		require.NoError(t, err)
+		num, err := res.LastInsertId()
+		require.NoError(t, err)
+		want = append(want, int(num))
+	}
+
+	// check
+	incomplete, err = store.FindIncompleteAddresses()
+	require.NoError(t, err)
+	require.Equal(t, want, parcelNumbers(incomplete))
+
+	// без заглушек находятся только пустые адреса
+	incomplete, err = NewParcelStore(db).FindIncompleteAddresses()
+	require.NoError(t, err)
+	require.Equal(t, want[len(want)-2:], parcelNumbers(incomplete))
+}
+
+// TestMetadata проверяет сохранение и замену метаданных посылки
+func TestMetadata(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	// add
+	parcel := getTestParcel()
+	parcel.Client = 1 + randRange.Intn(10_000_000)
+	parcel.Metadata = map[string]string{"fragile": "true", "carrier_ref": "AB-123"}
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, parcel.Metadata, got.Metadata)
+	byClient, err := store.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Contains(t, byClient, got)
+
+	// посылка без метаданных
+	plain, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	got, err = store.Get(plain)
+	require.NoError(t, err)
+	require.Nil(t, got.Metadata)
+
+	// set metadata
+	md := map[string]string{"carrier_ref": "CD-456"}
+	require.NoError(t, store.SetMetadata(num, md))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, md, got.Metadata)
+	require.Equal(t, 2, got.Version)
+
+	// пустая карта очищает метаданные так же, как nil
+	require.NoError(t, store.SetMetadata(num, map[string]string{}))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Nil(t, got.Metadata)
+
+	require.ErrorIs(t, store.SetMetadata(-1, md), ErrParcelNotFound)
+}
+
+// TestRecordDeliveryAttempt проверяет счётчик попыток доставки и возврат
+// посылки по достижении ограничения
+func TestRecordDeliveryAttempt(t *testing.T) {
+	// prepare
+	var changes []ParcelStatus
+	store := newTestStore(t, WithOnStatusChange(func(_ int, _, new ParcelStatus) {
+		changes = append(changes, new)
+	}))
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// попытка доставки не отправленной посылки
+	_, _, err = store.RecordDeliveryAttempt(num)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+	_, _, err = store.RecordDeliveryAttempt(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+	changes = nil
+
+	// check: первые попытки только увеличивают счётчик
+	for want := 1; want < defaultMaxDeliveryAttempts; want++ {
+		attempts, status, err := store.RecordDeliveryAttempt(num)
+		require.NoError(t, err)
+		require.Equal(t, want, attempts)
+		require.Equal(t, ParcelStatusSent, status)
+	}
+	require.Empty(t, changes)
+
+	// последняя попытка возвращает посылку
+	attempts, status, err := store.RecordDeliveryAttempt(num)
+	require.NoError(t, err)
+	require.Equal(t, defaultMaxDeliveryAttempts, attempts)
+	require.Equal(t, ParcelStatusReturned, status)
+	require.Equal(t, []ParcelStatus{ParcelStatusReturned}, changes)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, defaultMaxDeliveryAttempts, got.Attempts)
+	require.Equal(t, ParcelStatusReturned, got.Status)
+
+	// возвращённая посылка больше не доставляется
+	_, _, err = store.RecordDeliveryAttempt(num)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+}
+
+// TestFind проверяет отбор посылок по сочетанию условий ParcelFilter
+func TestFind(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type spec struct {
+		client int
+		sent   bool
+		day    int
+	}
+	specs := []spec{
+		{1000, false, 0},
+		{1000, true, 1},
+		{1000, false, 2},
+		{2000, false, 1},
+		{2000, true, 3},
+		{1000, false, 4},
+	}
+	numbers := make([]int, len(specs))
+	for i, sp := range specs {
+		parcel := getTestParcel()
+		parcel.Client = sp.client
+		parcel.CreatedAt = formatTime(base.AddDate(0, 0, sp.day))
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		if sp.sent {
+			require.NoError(t, store.SetStatus(num, ParcelStatusSent))
+		}
+		numbers[i] = num
+	}
+
+	client := 1000
+	registered := ParcelStatusRegistered
+	after := base
+	before := base.AddDate(0, 0, 4)
+
+	tests := map[string]struct {
+		filter ParcelFilter
+		want   []int
+	}{
+		"без условий": {ParcelFilter{}, numbers},
+		"клиент":      {ParcelFilter{Client: &client}, []int{numbers[0], numbers[1], numbers[2], numbers[5]}},
+		"клиент и статус": {
+			ParcelFilter{Client: &client, Status: &registered},
+			[]int{numbers[0], numbers[2], numbers[5]},
+		},
+		"клиент, статус и промежуток": {
+			ParcelFilter{Client: &client, Status: &registered, CreatedAfter: &after, CreatedBefore: &before},
+			[]int{numbers[2]},
+		},
+		"промежуток": {
+			ParcelFilter{CreatedAfter: &after, CreatedBefore: &before},
+			[]int{numbers[1], numbers[2], numbers[3], numbers[4]},
+		},
+		"страница": {
+			ParcelFilter{Status: &registered, Limit: 2, Offset: 1},
+			[]int{numbers[2], numbers[3]},
+		},
+		"смещение без ограничения": {
+			ParcelFilter{Client: &client, Offset: 3},
+			[]int{numbers[5]},
+		},
+		"ничего не найдено": {
+			ParcelFilter{Client: &client, CreatedBefore: &base},
+			[]int{},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			// check
+			got, err := store.Find(tt.filter)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, parcelNumbers(got))
+		})
+	}
+
+	_, err := store.Find(ParcelFilter{Limit: -1})
+	require.ErrorIs(t, err, ErrInvalidPagination)
+	_, err = store.Find(ParcelFilter{Offset: -1})
+	require.ErrorIs(t, err, ErrInvalidPagination)
+}
+
+// TestStream проверяет чтение всех посылок из канала
+func TestStream(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+
+	// stream
+	parcels, errc := store.Stream(context.Background())
+	var got []int
+	for p := range parcels {
+		got = append(got, p.Number)
+	}
+
+	// check
+	require.NoError(t, <-errc)
+	require.Equal(t, numbers, got)
+}
+
+// TestStreamCancel проверяет, что при отмене контекста Stream завершает
+// горутину и освобождает подключение, даже если посылки больше не читают
+func TestStreamCancel(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+	for i := 0; i < 10; i++ {
+		_, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+	}
+	goroutines := runtime.NumGoroutine()
+
+	// stream
+	ctx, cancel := context.WithCancel(context.Background())
+	parcels, errc := store.Stream(ctx)
+	<-parcels
+	cancel()
+
+	// check
+	require.ErrorIs(t, <-errc, context.Canceled)
+	// горутина Stream завершается асинхронно; require.Eventually не подходит,
+	// так как сам запускает горутину для проверки
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+	require.Zero(t, db.Stats().InUse)
+
+	// единственное подключение свободно для следующих запросов
+	_, err := store.GetAll()
+	require.NoError(t, err)
+}
+
+// TestSetStatusIf проверяет условную смену статуса
+func TestSetStatusIf(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// статус совпадает
+	require.NoError(t, store.SetStatusIf(num, ParcelStatusRegistered, ParcelStatusSent))
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+	require.Equal(t, 2, got.Version)
+	require.NotEmpty(t, got.ShippedAt)
+
+	// статус уже другой
+	err = store.SetStatusIf(num, ParcelStatusRegistered, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrStatusMismatch)
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, 2, got.Version)
+
+	// посылки нет
+	err = store.SetStatusIf(-1, ParcelStatusRegistered, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// недопустимый переход
+	err = store.SetStatusIf(num, ParcelStatusSent, ParcelStatusRegistered)
+	require.ErrorIs(t, err, ErrInvalidStatusTransition)
+}
+
+// TestCount проверяет общее количество посылок
+func TestCount(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	// add
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+	other := getTestParcel()
+	other.Client = 2000
+	_, err = store.Add(other)
+	require.NoError(t, err)
+
+	// check
+	count, err = store.Count()
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	// delete
+	require.NoError(t, store.Delete(numbers[0]))
+	count, err = store.Count()
+	require.NoError(t, err)
+	require.Equal(t, 3, count)
+}
+
+// TestBatchAddLenient проверяет, что BatchAddLenient добавляет корректные
+// посылки и сообщает об остальных
+func TestBatchAddLenient(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	taken, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	invalid := getTestParcel()
+	invalid.Client = 0
+	duplicate := getTestParcel()
+	duplicate.Number = taken
+	long := getTestParcel()
+	long.Address = strings.Repeat("a", defaultMaxAddressLength+1)
+	parcels := []Parcel{getTestParcel(), invalid, getTestParcel(), duplicate, long, getTestParcel()}
+
+	// add
+	numbers, failures, err := store.BatchAddLenient(parcels)
+	require.NoError(t, err)
+
+	// check
+	require.Len(t, numbers, 3)
+	for _, num := range numbers {
+		_, err := store.Get(num)
+		require.NoError(t, err)
+	}
+	require.Len(t, failures, 3)
+	require.Equal(t, 1, failures[0].Index)
+	require.ErrorIs(t, failures[0], ErrInvalidParcel)
+	require.Equal(t, 3, failures[1].Index)
+	require.ErrorIs(t, failures[1], ErrDuplicateNumber)
+	require.Equal(t, 4, failures[2].Index)
+	require.ErrorIs(t, failures[2], ErrAddressTooLong)
+
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Equal(t, 4, count)
+
+	// все посылки корректны
+	numbers, failures, err = store.BatchAddLenient([]Parcel{getTestParcel()})
+	require.NoError(t, err)
+	require.Len(t, numbers, 1)
+	require.Empty(t, failures)
+}
+
+// TestClientSummary проверяет сводку по посылкам клиента
+func TestClientSummary(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	created := []string{"2024-01-02T00:00:00Z", "2024-03-01T00:00:00Z", "2024-02-01T00:00:00Z", "2024-01-01T00:00:00Z"}
+	numbers := make([]int, len(created))
+	for i, ts := range created {
+		parcel := getTestParcel()
+		parcel.CreatedAt = ts
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		numbers[i] = num
+	}
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusSent))
+	require.NoError(t, store.SetStatus(numbers[1], ParcelStatusDelivered))
+	// посылка другого клиента не учитывается
+	other := getTestParcel()
+	other.Client = 2000
+	other.CreatedAt = "2025-01-01T00:00:00Z"
+	_, err := store.Add(other)
+	require.NoError(t, err)
+
+	// check
+	sum, err := store.ClientSummary(getTestParcel().Client)
+	require.NoError(t, err)
+	require.Equal(t, ClientSummary{
+		Total: 4,
+		ByStatus: map[ParcelStatus]int{
+			ParcelStatusRegistered: 2,
+			ParcelStatusSent:       1,
+			ParcelStatusDelivered:  1,
+		},
+		LastCreatedAt: "2024-03-01T00:00:00Z",
+	}, sum)
+
+	// клиент без посылок
+	sum, err = store.ClientSummary(-1)
+	require.NoError(t, err)
+	require.Equal(t, ClientSummary{}, sum)
+}
+
+// TestReRegister проверяет повторную регистрацию возвращённой посылки
+func TestReRegister(t *testing.T) {
+	// prepare
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return now }), WithMaxDeliveryAttempts(1))
+
+	returned, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(returned, ParcelStatusSent))
+	_, status, err := store.RecordDeliveryAttempt(returned)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusReturned, status)
+
+	sent, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(sent, ParcelStatusSent))
+
+	// re-register
+	now = now.Add(time.Hour)
+	require.NoError(t, store.ReRegister(returned))
+
+	// check
+	got, err := store.Get(returned)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusRegistered, got.Status)
+	require.Equal(t, formatTime(now), got.CreatedAt)
+	require.Empty(t, got.ShippedAt)
+	require.Empty(t, got.DeliveredAt)
+	require.Zero(t, got.Attempts)
+
+	// отправленную посылку зарегистрировать заново нельзя
+	require.ErrorIs(t, store.ReRegister(sent), ErrInvalidStatusTransition)
+	got, err = store.Get(sent)
+	require.NoError(t, err)
+	require.Equal(t, ParcelStatusSent, got.Status)
+
+	require.ErrorIs(t, store.ReRegister(-1), ErrParcelNotFound)
+}
+
+// TestChangedSince проверяет инкрементальную синхронизацию: после изменения
+// одной посылки следующая выборка возвращает только её
+func TestChangedSince(t *testing.T) {
+	// prepare
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newTestStore(t, WithClock(func() time.Time { return clock }))
+
+	numbers := make([]int, 3)
+	for i := range numbers {
+		parcel := getTestParcel()
+		parcel.CreatedAt = ""
+		num, err := store.Add(parcel)
+		require.NoError(t, err)
+		numbers[i] = num
+		clock = clock.Add(time.Second)
+	}
+
+	// sync ведёт себя как вызывающий: запрашивает изменения с последнего
+	// UpdatedAt и пропускает посылки, уже полученные с той же версией
+	var last time.Time
+	seen := map[[2]int]bool{}
+	sync := func(since time.Time) []Parcel {
+		changed, err := store.ChangedSince(since)
+		require.NoError(t, err)
+		res := []Parcel{}
+		for _, parcel := range changed {
+			key := [2]int{parcel.Number, parcel.Version}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			res = append(res, parcel)
+			last, err = time.Parse(time.RFC3339, parcel.UpdatedAt)
+			require.NoError(t, err)
+		}
+		return res
+	}
+
+	// первая синхронизация возвращает все посылки по порядку изменения
+	require.Equal(t, numbers, parcelNumbers(sync(time.Time{})))
+
+	// повторная синхронизация без изменений не даёт новых посылок
+	require.Empty(t, sync(last))
+
+	// изменение в ту же секунду, что и последняя синхронизация, не теряется
+	clock = clock.Add(-time.Second)
+	require.NoError(t, store.SetStatus(numbers[2], ParcelStatusSent))
+	changed := sync(last)
+	require.Equal(t, []int{numbers[2]}, parcelNumbers(changed))
+	require.Equal(t, ParcelStatusSent, changed[0].Status)
+
+	// mutate
+	clock = clock.Add(time.Minute)
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+
+	// check: граница в другом часовом поясе приводится к UTC
+	msk := time.FixedZone("MSK", 3*60*60)
+	changed = sync(last.In(msk))
+	require.Equal(t, []int{numbers[0]}, parcelNumbers(changed))
+	require.Equal(t, ParcelStatusSent, changed[0].Status)
+}
+
+// TestTruncateAll проверяет, что TruncateAll удаляет все посылки и историю
+// и номера снова выдаются с 1
+func TestTruncateAll(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+
+	numbers, err := store.BatchAdd([]Parcel{getTestParcel(), getTestParcel(), getTestParcel()})
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(numbers[0], ParcelStatusSent))
+	require.NoError(t, store.SoftDelete(numbers[1]))
+
+	// truncate
+	require.NoError(t, store.TruncateAll())
+
+	// check
+	count, err := store.Count()
+	require.NoError(t, err)
+	require.Zero(t, count)
+	history, err := store.History(numbers[0])
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.Equal(t, 1, num)
+}
+
+// TestDeliveryWindow проверяет задание, снятие и проверку окна доставки
+func TestDeliveryWindow(t *testing.T) {
+	// prepare
+	store := newTestStore(t)
+	msk := time.FixedZone("MSK", 3*60*60)
+	after := time.Date(2024, 3, 1, 12, 0, 0, 0, msk)
+	before := after.Add(4 * time.Hour)
+
+	// add: края окна приводятся к UTC
+	parcel := getTestParcel()
+	parcel.DeliverAfter = after.Format(time.RFC3339)
+	num, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	got, err := store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "2024-03-01T09:00:00Z", got.DeliverAfter)
+	require.Empty(t, got.DeliverBefore)
+
+	// начало окна не раньше конца
+	parcel.DeliverBefore = after.Format(time.RFC3339)
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrInvalidParcel)
+	require.ErrorIs(t, err, ErrInvalidDeliveryWindow)
+
+	// set
+	require.NoError(t, store.SetDeliveryWindow(num, &after, &before))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Equal(t, "2024-03-01T09:00:00Z", got.DeliverAfter)
+	require.Equal(t, "2024-03-01T13:00:00Z", got.DeliverBefore)
+	require.Equal(t, 2, got.Version)
+
+	// clear: незаданные края хранятся как NULL
+	require.NoError(t, store.SetDeliveryWindow(num, nil, &before))
+	got, err = store.Get(num)
+	require.NoError(t, err)
+	require.Empty(t, got.DeliverAfter)
+	require.Equal(t, "2024-03-01T13:00:00Z", got.DeliverBefore)
+
+	require.NoError(t, store.SetDeliveryWindow(num, nil, nil))
+	var nulls int
+	err = store.db.QueryRow(`SELECT COUNT(*) FROM "parcel" WHERE number = ? AND deliver_after IS NULL AND deliver_before IS NULL`, num).Scan(&nulls)
+	require.NoError(t, err)
+	require.Equal(t, 1, nulls)
+
+	// invalid
+	require.ErrorIs(t, store.SetDeliveryWindow(num, &before, &after), ErrInvalidDeliveryWindow)
+	require.ErrorIs(t, store.SetDeliveryWindow(-1, &after, &before), ErrParcelNotFound)
+}
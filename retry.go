@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// retryPolicy задаёт повтор операций при временных ошибках
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+}
+
+// withRetry выполняет fn и повторяет её, пока она возвращает временную ошибку
+// и не исчерпаны попытки. Пауза между попытками удваивается.
+// Остальные ошибки возвращаются сразу, а при отмене ctx — ctx.Err().
+// Через withRetry проходят все изменяющие операции, поэтому в режиме
+// WithReadOnly она сразу возвращает ErrReadOnly, не выполняя fn.
+func (s ParcelStore) withRetry(ctx context.Context, fn func() error) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	attempts := s.retry.attempts
+	if s.tx != nil {
+		// транзакцией, заданной через WithTx, управляет вызывающий:
+		// после ошибки она может быть уже непригодна, повторять внутри неё нельзя
+		attempts = 0
+	}
+
+	delay := s.retry.baseDelay
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err != nil && ctx.Err() != nil {
+			// отмена посреди запроса приходит от драйвера своей ошибкой
+			// (в SQLite — SQLITE_INTERRUPT); возвращаем ошибку контекста,
+			// чтобы её можно было проверить через errors.Is
+			return ctx.Err()
+		}
+		if err == nil || attempt >= attempts || !isRetryable(err) {
+			return err
+		}
+		s.logger.LogAttrs(ctx, slog.LevelWarn, "retrying after transient error",
+			slog.Int("attempt", attempt+1),
+			slog.Int("attempts", attempts),
+			slog.Duration("delay", delay),
+			slog.Any("error", err))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// isRetryable сообщает, что ошибка временная и операцию можно повторить:
+// база занята другим соединением или строка заблокирована
+func isRetryable(err error) bool {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return true
+		}
+		return false
+	}
+
+	// 40001 — serialization_failure, 40P01 — deadlock_detected
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) {
+		switch pgErr.SQLState() {
+		case "40001", "40P01":
+			return true
+		}
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lockDB открывает второе подключение к файлу базы и берёт на нём
+// эксклюзивную блокировку. Возвращает функцию, снимающую блокировку;
+// её можно вызывать из любой горутины, ошибка возвращается вызывающему.
+func lockDB(t *testing.T, path string) func() error {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	conn, err := db.Conn(context.Background())
+	require.NoError(t, err)
+	_, err = conn.ExecContext(context.Background(), "BEGIN EXCLUSIVE")
+	require.NoError(t, err)
+
+	return func() error {
+		if _, err := conn.ExecContext(context.Background(), "COMMIT"); err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// TestRetryOnLocked проверяет повтор записи, пока база заблокирована
+func TestRetryOnLocked(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db, WithRetry(10, 10*time.Millisecond))
+	require.NoError(t, store.Migrate())
+
+	// блокировка снимается через некоторое время, и повтор должен пройти
+	unlock := lockDB(t, path)
+	unlocked := make(chan error, 1)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		unlocked <- unlock()
+	}()
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NotEmpty(t, num)
+	require.NoError(t, <-unlocked)
+}
+
+// TestNoRetry проверяет, что без WithRetry ошибка блокировки возвращается сразу,
+// а постоянные ошибки не повторяются
+func TestNoRetry(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	unlock := lockDB(t, path)
+	_, err = store.Add(getTestParcel())
+	require.Error(t, err)
+	require.True(t, isRetryable(err))
+	require.NoError(t, unlock())
+
+	// остальные ошибки возвращаются сразу даже при включённых повторах
+	store = NewParcelStore(db, WithRetry(10, time.Second))
+	start := time.Now()
+	err = store.SetStatus(-1, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// TestCancelWhileLocked проверяет отмену контекста посреди операции: запись
+// ждёт снятия блокировки, и отмена должна прервать ожидание
+func TestCancelWhileLocked(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	store := NewParcelStore(db, WithRetry(1000, 10*time.Millisecond))
+	require.NoError(t, store.Migrate())
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	unlock := lockDB(t, path)
+	defer func() { require.NoError(t, unlock()) }()
+
+	ops := map[string]func(ctx context.Context) error{
+		"Add": func(ctx context.Context) error {
+			_, err := store.AddContext(ctx, getTestParcel())
+			return err
+		},
+		"BatchAdd": func(ctx context.Context) error {
+			_, err := store.BatchAddContext(ctx, []Parcel{getTestParcel(), getTestParcel()})
+			return err
+		},
+		"AddAndGet": func(ctx context.Context) error {
+			_, err := store.AddAndGetContext(ctx, getTestParcel())
+			return err
+		},
+		"SetStatus": func(ctx context.Context) error {
+			return store.SetStatusContext(ctx, num, ParcelStatusSent)
+		},
+		"SetAddress": func(ctx context.Context) error {
+			return store.SetAddressContext(ctx, num, "new test address")
+		},
+		"SetStatusAndAddress": func(ctx context.Context) error {
+			return store.SetStatusAndAddressContext(ctx, num, ParcelStatusSent, "new test address")
+		},
+		"Delete": func(ctx context.Context) error {
+			return store.DeleteContext(ctx, num)
+		},
+		"DeleteByClient": func(ctx context.Context) error {
+			_, err := store.DeleteByClientContext(ctx, getTestParcel().Client)
+			return err
+		},
+	}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(30*time.Millisecond, cancel)
+
+			start := time.Now()
+			err := op(ctx)
+			require.ErrorIs(t, err, context.Canceled)
+			// без отмены операция ждала бы блокировку до 1000 повторов
+			require.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+// TestInTx проверяет, что InTx повторяет транзакцию целиком после временной
+// ошибки и откатывает изменения неудачной попытки
+func TestInTx(t *testing.T) {
+	// prepare
+	store := newTestStore(t, WithRetry(3, time.Millisecond))
+
+	insert := func(tx *sql.Tx) error {
+		_, err := tx.Exec(`INSERT INTO "parcel" (client, status, address, created_at) VALUES (1000, 'registered', 'test', '')`)
+		return err
+	}
+
+	// первая попытка вставляет строку и получает ошибку блокировки
+	calls := 0
+	err := store.InTx(context.Background(), func(tx *sql.Tx) error {
+		calls++
+		if err := insert(tx); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return errors.New("database is locked (5) (SQLITE_BUSY)")
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// check: строка первой попытки откачена
+	parcels, err := store.GetByClient(1000)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+
+	// постоянная ошибка не повторяется, и изменения откатываются
+	calls = 0
+	failure := errors.New("failure")
+	err = store.InTx(context.Background(), func(tx *sql.Tx) error {
+		calls++
+		if err := insert(tx); err != nil {
+			return err
+		}
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, 1, calls)
+
+	parcels, err = store.GetByClient(1000)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// parcelSchema создаёт таблицы посылок и истории их изменений и индексы к ним,
+// если их ещё нет. Вместо %[1]s подставляется имя таблицы посылок; все имена
+// в кавычках, как и в запросах хранилища (см. quoteIdent).
+var parcelSchema = map[Dialect][]string{
+	DialectSQLite: {
+		`CREATE TABLE IF NOT EXISTS "%[1]s"
+(
+    number          integer
+        constraint "%[1]s_pk"
+            primary key autoincrement,
+    client          integer          not null,
+    status          VARCHAR(128)     not null,
+    address         VARCHAR(512)     not null,
+    created_at      text             not null,
+    updated_at      text             not null default '',
+    version         integer          not null default 1,
+    deleted_at      text             not null default '',
+    shipped_at      text             not null default '',
+    delivered_at    text             not null default '',
+    idempotency_key VARCHAR(128)     not null default '',
+    weight          double precision not null default 0,
+    metadata        text             not null default '{}',
+    attempts        integer          not null default 0
+)`,
+		`CREATE INDEX IF NOT EXISTS "%[1]s_client_idx" ON "%[1]s" (client)`,
+		`CREATE TABLE IF NOT EXISTS "%[1]s_history"
+(
+    id         integer
+        constraint "%[1]s_history_pk"
+            primary key autoincrement,
+    number     integer      not null,
+    field      VARCHAR(32)  not null,
+    old_value  VARCHAR(512) not null,
+    new_value  VARCHAR(512) not null,
+    changed_at text         not null
+)`,
+		`CREATE INDEX IF NOT EXISTS "%[1]s_history_number_idx" ON "%[1]s_history" (number)`,
+	},
+	DialectPostgres: {
+		`CREATE TABLE IF NOT EXISTS "%[1]s"
+(
+    number          serial
+        constraint "%[1]s_pk"
+            primary key,
+    client          integer          not null,
+    status          VARCHAR(128)     not null,
+    address         VARCHAR(512)     not null,
+    created_at      text             not null,
+    updated_at      text             not null default '',
+    version         integer          not null default 1,
+    deleted_at      text             not null default '',
+    shipped_at      text             not null default '',
+    delivered_at    text             not null default '',
+    idempotency_key VARCHAR(128)     not null default '',
+    weight          double precision not null default 0,
+    metadata        text             not null default '{}',
+    attempts        integer          not null default 0
+)`,
+		`CREATE INDEX IF NOT EXISTS "%[1]s_client_idx" ON "%[1]s" (client)`,
+		`CREATE TABLE IF NOT EXISTS "%[1]s_history"
+(
+    id         serial
+        constraint "%[1]s_history_pk"
+            primary key,
+    number     integer      not null,
+    field      VARCHAR(32)  not null,
+    old_value  VARCHAR(512) not null,
+    new_value  VARCHAR(512) not null,
+    changed_at text         not null
+)`,
+		`CREATE INDEX IF NOT EXISTS "%[1]s_history_number_idx" ON "%[1]s_history" (number)`,
+	},
+}
+
+// column — колонка, добавляемая шагом схемы в уже существующую таблицу
+type column struct {
+	name       string
+	definition string
+}
+
+// parcelAddedColumns — колонки, появившиеся после первой версии схемы
+// и до появления таблицы миграций. Migrate добавляет их в таблицы, созданные
+// до их появления; более поздние колонки добавляются своими шагами схемы.
+var parcelAddedColumns = []column{
+	{"updated_at", "text not null default ''"},
+	{"version", "integer not null default 1"},
+	{"deleted_at", "text not null default ''"},
+	{"shipped_at", "text not null default ''"},
+	{"delivered_at", "text not null default ''"},
+	{"idempotency_key", "VARCHAR(128) not null default ''"},
+	{"weight", "double precision not null default 0"},
+	{"metadata", "text not null default '{}'"},
+	{"attempts", "integer not null default 0"},
+}
+
+// parcelIndexes создаёт индексы по колонкам из parcelAddedColumns. Migrate
+// выполняет их после добавления колонок, так как в старых таблицах колонок
+// может не быть. Синтаксис одинаков в SQLite и PostgreSQL.
+var parcelIndexes = []string{
+	// ключ идемпотентности уникален среди неудалённых посылок клиента
+	`CREATE UNIQUE INDEX IF NOT EXISTS "%[1]s_idempotency_idx" ON "%[1]s" (client, idempotency_key)
+	WHERE idempotency_key <> '' AND deleted_at = ''`,
+}
+
+// columnsQuery выбирает имена колонок таблицы :table в порядке их следования
+var columnsQuery = map[Dialect]string{
+	DialectSQLite: "SELECT name FROM pragma_table_info(:table) ORDER BY cid",
+	DialectPostgres: `SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = :table ORDER BY ordinal_position`,
+}
+
+// migration — шаг изменения схемы. Шаги выполняются по порядку, каждый в своей
+// транзакции, и номер выполненного шага записывается в таблицу миграций.
+// Шаги написаны так, чтобы их можно было выполнить и на базе, схема которой
+// создана до появления таблицы миграций.
+type migration struct {
+	version int
+	apply   func(ctx context.Context, s ParcelStore, tx querier) error
+}
+
+// parcelMigrations — шаги схемы по возрастанию версии. Новые изменения схемы
+// добавляются в конец новым шагом; уже выпущенные шаги не меняются.
+var parcelMigrations = []migration{
+	{1, func(ctx context.Context, s ParcelStore, tx querier) error {
+		return s.execAll(ctx, tx, parcelSchema[s.dialect])
+	}},
+	{2, func(ctx context.Context, s ParcelStore, tx querier) error {
+		return s.addColumns(ctx, tx, parcelAddedColumns)
+	}},
+	{3, func(ctx context.Context, s ParcelStore, tx querier) error {
+		return s.execAll(ctx, tx, parcelIndexes)
+	}},
+	{4, func(ctx context.Context, s ParcelStore, tx querier) error {
+		// индекс для выборки изменений в ChangedSince
+		return s.execAll(ctx, tx, []string{
+			`CREATE INDEX IF NOT EXISTS "%[1]s_updated_at_idx" ON "%[1]s" (updated_at)`,
+		})
+	}},
+	{5, func(ctx context.Context, s ParcelStore, tx querier) error {
+		// окно доставки; колонки добавляются и в новых базах, так как
+		// выпущенный шаг 1 не меняется. NULL означает, что край окна не задан
+		return s.addColumns(ctx, tx, []column{
+			{"deliver_after", "text"},
+			{"deliver_before", "text"},
+		})
+	}},
+}
+
+// LatestSchemaVersion возвращает версию схемы, которую создаёт Migrate. Если
+// SchemaVersion базы меньше, для работы с ней сначала нужно выполнить Migrate.
+func LatestSchemaVersion() int {
+	return parcelMigrations[len(parcelMigrations)-1].version
+}
+
+// migrationsSchema создаёт таблицу выполненных шагов схемы
+const migrationsSchema = `CREATE TABLE IF NOT EXISTS "%[1]s_schema_migrations"
+(
+    version    integer not null
+        constraint "%[1]s_schema_migrations_pk"
+            primary key,
+    applied_at text    not null
+)`
+
+// Migrate создаёт схему базы данных или доводит её до последней версии,
+// выполняя ещё не выполненные шаги; номера выполненных шагов хранятся в
+// таблице <таблица посылок>_schema_migrations. Вызывается один раз при старте
+// приложения; повторный вызов безопасен.
+func (s ParcelStore) Migrate() (err error) {
+	ctx := context.Background()
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Migrate", start, err) }()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if _, err := s.conn().ExecContext(ctx, fmt.Sprintf(migrationsSchema, s.table)); err != nil {
+		return err
+	}
+	current, err := s.schemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range parcelMigrations {
+		if m.version <= current {
+			continue
+		}
+		err := s.inTx(ctx, func(tx querier) error {
+			if err := m.apply(ctx, s, tx); err != nil {
+				return err
+			}
+			// время выполнения шага — служебное, поэтому оно не берётся из WithClock
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO "+s.migrationsTable()+" (version, applied_at) VALUES (:version, :applied_at)",
+				sql.Named("version", m.version),
+				sql.Named("applied_at", formatTime(time.Now())))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("schema version %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// SchemaVersion возвращает версию схемы базы — номер последнего выполненного
+// шага Migrate, или 0, если Migrate ещё не выполнялся. Сравнив её с
+// LatestSchemaVersion, приложение может отказаться работать с устаревшей схемой.
+func (s ParcelStore) SchemaVersion() (int, error) {
+	return s.SchemaVersionContext(context.Background())
+}
+
+func (s ParcelStore) SchemaVersionContext(ctx context.Context) (version int, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "SchemaVersion", start, err) }()
+
+	existing, err := s.tableColumns(ctx, s.conn(), s.table+"_schema_migrations")
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) == 0 {
+		return 0, nil
+	}
+	return s.schemaVersion(ctx)
+}
+
+// schemaVersion возвращает номер последнего шага из таблицы миграций
+func (s ParcelStore) schemaVersion(ctx context.Context) (int, error) {
+	var version int
+	row := s.conn().QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM "+s.migrationsTable())
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// migrationsTable возвращает имя таблицы миграций в кавычках
+func (s ParcelStore) migrationsTable() string {
+	return quoteIdent(s.table + "_schema_migrations")
+}
+
+// execAll выполняет запросы схемы, подставляя в них имя таблицы посылок
+func (s ParcelStore) execAll(ctx context.Context, q querier, queries []string) error {
+	for _, query := range queries {
+		if _, err := q.ExecContext(ctx, fmt.Sprintf(query, s.table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumns добавляет в таблицу посылок колонки из columns, которых в ней нет
+func (s ParcelStore) addColumns(ctx context.Context, tx querier, columns []column) error {
+	existing, err := s.tableColumns(ctx, tx, s.table)
+	if err != nil {
+		return err
+	}
+	for _, col := range columns {
+		if existing[col.name] {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", s.ident(), col.name, col.definition)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableColumns возвращает множество колонок таблицы table; для
+// несуществующей таблицы оно пусто
+func (s ParcelStore) tableColumns(ctx context.Context, q querier, table string) (map[string]bool, error) {
+	names, err := s.tableColumnNames(ctx, q, table)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bool, len(names))
+	for _, name := range names {
+		res[name] = true
+	}
+	return res, nil
+}
+
+// tableColumnNames возвращает имена колонок таблицы table в порядке их следования
+func (s ParcelStore) tableColumnNames(ctx context.Context, q querier, table string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, columnsQuery[s.dialect], sql.Named("table", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Columns возвращает имена колонок таблицы посылок в базе в порядке их
+// следования; если таблицы нет, возвращается пустой срез
+func (s ParcelStore) Columns() ([]string, error) {
+	return s.ColumnsContext(context.Background())
+}
+
+func (s ParcelStore) ColumnsContext(ctx context.Context) (_ []string, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Columns", start, err) }()
+
+	return s.tableColumnNames(ctx, s.conn(), s.table)
+}
+
+// expectedColumns — колонки таблицы посылок, которые создаёт Migrate
+func expectedColumns() []string {
+	return append(strings.Split(parcelColumns, ", "), "deleted_at")
+}
+
+// VerifySchema сверяет колонки таблицы посылок в базе с теми, что создаёт
+// Migrate, и при расхождении возвращает ошибку ErrSchemaMismatch со списком
+// недостающих и лишних колонок. Позволяет при старте приложения обнаружить
+// схему, изменённую в обход Migrate.
+func (s ParcelStore) VerifySchema() error {
+	return s.VerifySchemaContext(context.Background())
+}
+
+func (s ParcelStore) VerifySchemaContext(ctx context.Context) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "VerifySchema", start, err) }()
+
+	existing, err := s.tableColumns(ctx, s.conn(), s.table)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("table %s: %w", s.table, ErrSchemaMissing)
+	}
+
+	var missing, unexpected []string
+	expected := map[string]bool{}
+	for _, name := range expectedColumns() {
+		expected[name] = true
+		if !existing[name] {
+			missing = append(missing, name)
+		}
+	}
+	for name := range existing {
+		if !expected[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+	sort.Strings(unexpected)
+	return fmt.Errorf("table %s: %w: missing columns %v, unexpected columns %v",
+		s.table, ErrSchemaMismatch, missing, unexpected)
+}
+
+// Ping проверяет, что база доступна и в ней есть таблица посылок. Если таблицы
+// нет (не выполнен Migrate), возвращается ErrSchemaMissing.
+func (s ParcelStore) Ping(ctx context.Context) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Ping", start, err) }()
+
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+
+	existing, err := s.tableColumns(ctx, s.conn(), s.table)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("table %s: %w", s.table, ErrSchemaMissing)
+	}
+	return nil
+}
+
+// Vacuum обслуживает базу после массовых удалений: в SQLite выполняет VACUUM,
+// возвращая освобождённое место, в PostgreSQL — ANALYZE таблицы посылок.
+// VACUUM перестраивает весь файл базы и на всё время работы блокирует запись,
+// поэтому его лучше запускать в период низкой нагрузки. Операцию можно прервать
+// через ctx. Внутри транзакции, заданной через WithTx, VACUUM невозможен.
+func (s ParcelStore) Vacuum(ctx context.Context) (err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	start := time.Now()
+	defer func() { err = s.observe(ctx, "Vacuum", start, err) }()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	if s.tx != nil {
+		return errors.New("vacuum is not supported inside a transaction")
+	}
+
+	query := "VACUUM"
+	if s.dialect == DialectPostgres {
+		query = "ANALYZE " + s.ident()
+	}
+	_, err = s.db.ExecContext(ctx, query)
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// stmtCache хранит подготовленные запросы по их тексту. Кэш общий для всех
+// копий ParcelStore, полученных из одного NewParcelStore.
+type stmtCache struct {
+	mu    sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: map[string]*sql.Stmt{}}
+}
+
+// prepare возвращает подготовленный запрос, при первом обращении готовя его.
+// *sql.Stmt, подготовленный на *sql.DB, сам переподготавливается на других
+// соединениях пула, поэтому его можно использовать из любой горутины.
+func (c *stmtCache) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close закрывает все подготовленные запросы и очищает кэш
+func (c *stmtCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for query, stmt := range c.stmts {
+		errs = append(errs, stmt.Close())
+		delete(c.stmts, query)
+	}
+	return errors.Join(errs...)
+}
+
+// preparedQuerier выполняет запросы к db через подготовленные запросы из кэша
+type preparedQuerier struct {
+	db    *sql.DB
+	cache *stmtCache
+}
+
+func (p preparedQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	stmt, err := p.cache.prepare(ctx, p.db, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (p preparedQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	stmt, err := p.cache.prepare(ctx, p.db, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (p preparedQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	stmt, err := p.cache.prepare(ctx, p.db, query)
+	if err != nil {
+		// *sql.Row нельзя создать с ошибкой: запрос без подготовки вернёт
+		// ту же ошибку из Scan
+		return p.db.QueryRowContext(ctx, query, args...)
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+// prepared возвращает querier, выполняющий запросы через подготовленные запросы.
+// Используется на частых путях (Get, Add). Подготовленный запрос привязан
+// к *sql.DB, поэтому внутри транзакции, заданной через WithTx, запросы
+// выполняются без подготовки.
+func (s ParcelStore) prepared() querier {
+	if s.tx != nil || s.stmts == nil {
+		return s.conn()
+	}
+	return s.dialect.wrap(preparedQuerier{db: s.db, cache: s.stmts})
+}
+
+// Close освобождает ресурсы, созданные хранилищем, — подготовленные запросы.
+// База данных закрывается, только если хранилище создано с WithOwnedDB;
+// иначе ею владеет вызывающий, и после Close хранилище можно использовать
+// дальше: запросы будут подготовлены заново.
+func (s ParcelStore) Close() error {
+	var err error
+	if s.stmts != nil {
+		err = s.stmts.close()
+	}
+	if s.ownsDB && s.db != nil {
+		err = errors.Join(err, s.db.Close())
+	}
+	return wrapErr("Close", err)
+}
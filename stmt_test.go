@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPreparedStatements проверяет кэширование подготовленных запросов
+func TestPreparedStatements(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	defer store.Close()
+	require.NoError(t, store.Migrate())
+
+	// add & get
+	for i := 0; i < 3; i++ {
+		num, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		_, err = store.Get(num)
+		require.NoError(t, err)
+	}
+
+	// check
+	// каждый запрос готовится один раз, кэш общий для копий хранилища
+	require.Len(t, store.stmts.stmts, 2)
+	copied := store
+	_, err := copied.Get(-1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+	require.Len(t, store.stmts.stmts, 2)
+
+	// после Close хранилище продолжает работать
+	require.NoError(t, store.Close())
+	require.Empty(t, store.stmts.stmts)
+	num, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.Get(num)
+	require.NoError(t, err)
+
+	// нулевое хранилище Close не ломает
+	require.NoError(t, ParcelStore{}.Close())
+}
+
+// TestCloseBorrowedDB проверяет, что Close не закрывает базу вызывающего
+func TestCloseBorrowedDB(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db)
+	require.NoError(t, store.Migrate())
+
+	// close
+	require.NoError(t, store.Close())
+
+	// check
+	require.NoError(t, db.Ping())
+	_, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+}
+
+// TestCloseOwnedDB проверяет, что с WithOwnedDB Close закрывает и базу,
+// а хранилище из WithTx её не закрывает
+func TestCloseOwnedDB(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	store := NewParcelStore(db, WithOwnedDB())
+	require.NoError(t, store.Migrate())
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	require.NoError(t, store.WithTx(tx).Close())
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, db.Ping())
+
+	// close
+	require.NoError(t, store.Close())
+
+	// check
+	require.Error(t, db.Ping())
+}
+
+// BenchmarkGet сравнивает Get через подготовленный запрос и без подготовки
+func BenchmarkGet(b *testing.B) {
+	store := newTestStore(b)
+	defer store.Close()
+
+	num, err := store.Add(getTestParcel())
+	require.NoError(b, err)
+	ctx := context.Background()
+
+	b.Run("prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.getParcel(ctx, store.prepared(), num); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unprepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.getParcel(ctx, store.conn(), num); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}